@@ -0,0 +1,373 @@
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+)
+
+const (
+	authorizationHeader = "authorization"
+	bearerPrefix        = "Bearer "
+	tapBufferSize       = 256
+	defaultEnrollTTL    = 24 * time.Hour
+)
+
+// AdminConfig admin API settings, every request must carry the token in the authorization header
+type AdminConfig struct {
+	Host          string
+	Port          int
+	Token         string
+	Cert          string
+	Key           string
+	Subscriptions []Subscription
+}
+
+// Subscription topic filter subscribed on the local broker
+type Subscription struct {
+	Topic string
+	QoS   int
+}
+
+// adminTarget is the server or the client managed by the admin API
+type adminTarget interface {
+	pendingQueues() map[string]queue
+	peerInfos() []*apiV1.PeerInfo
+	disconnectPeers(id uint64, name string) int
+	flushQueue(name string) (int, error)
+}
+
+// AdminServer serves the admin API on a separate listener
+type AdminServer struct {
+	apiV1.UnimplementedAdminServer
+	cfg     *AdminConfig
+	log     *logger.Logger
+	lst     net.Listener
+	srv     *grpc.Server
+	targets []adminTarget
+	server  *Server
+	tap     *tap.Hub
+	sync.RWMutex
+}
+
+func NewAdminServer(ctx context.Context, cfg *AdminConfig, log *logger.Logger) (*AdminServer, error) {
+	if len(cfg.Token) == 0 {
+		return nil, errors.New("admin API token is not set")
+	}
+
+	s := &AdminServer{
+		cfg: cfg,
+		log: log,
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	}
+
+	if len(cfg.Cert) != 0 {
+		tlsCredentials, err := credentials.NewServerTLSFromFile(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin API certificate: %w", err)
+		}
+		opts = append(opts, grpc.Creds(tlsCredentials))
+	}
+
+	var err error
+	s.lst, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	s.srv = grpc.NewServer(opts...)
+	apiV1.RegisterAdminServer(s.srv, s)
+	reflection.Register(s.srv)
+
+	entity.GetWg(ctx).Add(1)
+	go func() {
+		<-ctx.Done()
+		s.srv.Stop()
+		s.log.Info().Msg("admin server stopped")
+		entity.GetWg(ctx).Done()
+	}()
+
+	return s, nil
+}
+
+// SetServer makes the gRPC server manageable by the admin API
+func (s *AdminServer) SetServer(srv *Server) {
+	s.Lock()
+	s.server = srv
+	s.Unlock()
+	s.addTarget(srv)
+}
+
+// SetClient makes the gRPC client manageable by the admin API
+func (s *AdminServer) SetClient(cli *Client) {
+	s.addTarget(cli)
+}
+
+// SetTap sets the live feed of messages served by the Tap method
+func (s *AdminServer) SetTap(hub *tap.Hub) {
+	s.Lock()
+	s.tap = hub
+	s.Unlock()
+}
+
+func (s *AdminServer) Start() {
+	s.log.Info().
+		Bool("tls", len(s.cfg.Cert) != 0).
+		Str("host", s.cfg.Host).
+		Int("port", s.cfg.Port).
+		Msg("admin server started")
+	go func() {
+		if err := s.srv.Serve(s.lst); err != nil {
+			s.log.Fatalf("failed to serve admin API: %v", err)
+		}
+	}()
+}
+
+func (s *AdminServer) ListPeers(_ context.Context, _ *apiV1.ListPeersRequest) (*apiV1.ListPeersResponse, error) {
+	resp := &apiV1.ListPeersResponse{}
+	for _, t := range s.getTargets() {
+		resp.Peers = append(resp.Peers, t.peerInfos()...)
+	}
+	return resp, nil
+}
+
+func (s *AdminServer) ListSubscriptions(_ context.Context, _ *apiV1.ListSubscriptionsRequest) (*apiV1.ListSubscriptionsResponse, error) {
+	resp := &apiV1.ListSubscriptionsResponse{
+		Subscriptions: make([]*apiV1.Subscription, 0, len(s.cfg.Subscriptions)),
+	}
+	for _, sub := range s.cfg.Subscriptions {
+		resp.Subscriptions = append(resp.Subscriptions, &apiV1.Subscription{Topic: sub.Topic, Qos: uint32(sub.QoS)})
+	}
+	return resp, nil
+}
+
+func (s *AdminServer) ListQueues(_ context.Context, _ *apiV1.ListQueuesRequest) (*apiV1.ListQueuesResponse, error) {
+	resp := &apiV1.ListQueuesResponse{}
+	for _, t := range s.getTargets() {
+		queues := t.pendingQueues()
+		for _, name := range slices.Sorted(maps.Keys(queues)) {
+			resp.Queues = append(resp.Queues, &apiV1.QueueInfo{Name: name, Length: uint64(queues[name].Len())})
+		}
+	}
+	return resp, nil
+}
+
+func (s *AdminServer) DumpQueue(_ context.Context, req *apiV1.DumpQueueRequest) (*apiV1.DumpQueueResponse, error) {
+	_, _, q, err := s.findQueue(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := q.Dump(int(req.Limit))
+	resp := &apiV1.DumpQueueResponse{Messages: make([]*apiV1.Message, 0, len(messages))}
+	for _, m := range messages {
+		resp.Messages = append(resp.Messages, newProtoMessage(m))
+	}
+
+	return resp, nil
+}
+
+func (s *AdminServer) DisconnectPeer(_ context.Context, req *apiV1.DisconnectPeerRequest) (*apiV1.DisconnectPeerResponse, error) {
+	if req.Id == 0 && len(req.Name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "peer id or name is required")
+	}
+
+	var n int
+	for _, t := range s.getTargets() {
+		n += t.disconnectPeers(req.Id, req.Name)
+	}
+	if n == 0 {
+		return nil, status.Error(codes.NotFound, "peer not found")
+	}
+
+	s.log.Info().Uint64("id", req.Id).Str("name", req.Name).Int("count", n).Msg("peers disconnected by the administrator")
+
+	return &apiV1.DisconnectPeerResponse{Disconnected: uint32(n)}, nil
+}
+
+func (s *AdminServer) FlushQueue(_ context.Context, req *apiV1.QueueRequest) (*apiV1.QueueResponse, error) {
+	t, name, _, err := s.findQueue(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := t.flushQueue(name)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "sent %d messages: %v", n, err)
+	}
+
+	return &apiV1.QueueResponse{Count: uint64(n)}, nil
+}
+
+func (s *AdminServer) PurgeQueue(_ context.Context, req *apiV1.QueueRequest) (*apiV1.QueueResponse, error) {
+	_, name, q, err := s.findQueue(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	n := q.Purge()
+	s.log.Info().Str("queue", name).Int("count", n).Msg("queue purged by the administrator")
+
+	return &apiV1.QueueResponse{Count: uint64(n)}, nil
+}
+
+func (s *AdminServer) Tap(req *apiV1.TapRequest, stream apiV1.Admin_TapServer) error {
+	s.RLock()
+	hub := s.tap
+	s.RUnlock()
+	if hub == nil {
+		return status.Error(codes.Unavailable, "message feed is not available")
+	}
+
+	switch req.Direction {
+	case "", entity.DirectionInbound, entity.DirectionOutbound:
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown direction %q", req.Direction)
+	}
+
+	sub, err := hub.Subscribe(tap.Filter{
+		Topics:    req.Topics,
+		Direction: req.Direction,
+		Peer:      req.Peer,
+		Dropped:   req.DroppedOnly,
+	}, tapBufferSize)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer hub.Unsubscribe(sub)
+
+	s.log.Info().Strs("topics", req.Topics).Str("direction", req.Direction).Str("peer", req.Peer).Msg("message feed started")
+	defer s.log.Info().Msg("message feed stopped")
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-sub.C:
+			if err := stream.Send(&apiV1.TapEvent{
+				Time:      e.Time.UnixNano(),
+				Direction: e.Direction,
+				Peer:      e.Peer,
+				Topic:     e.Topic,
+				Payload:   e.Payload,
+				Qos:       uint32(e.QoS),
+				Retained:  e.Retained,
+				Dropped:   e.Dropped,
+				Reason:    e.Reason,
+				Lost:      sub.Lost(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *AdminServer) CreateEnrollmentToken(_ context.Context, req *apiV1.CreateEnrollmentTokenRequest) (*apiV1.CreateEnrollmentTokenResponse, error) {
+	s.RLock()
+	srv := s.server
+	s.RUnlock()
+	if srv == nil {
+		return nil, errEnrollmentDisabled
+	}
+
+	if len(req.CommonName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "common name is required")
+	}
+
+	ttl := time.Duration(req.Ttl) * time.Second
+	if ttl == 0 {
+		ttl = defaultEnrollTTL
+	}
+
+	token, expires, err := srv.createEnrollmentToken(req.CommonName, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiV1.CreateEnrollmentTokenResponse{Token: token, ExpiresAt: expires.UnixNano()}, nil
+}
+
+func (s *AdminServer) addTarget(t adminTarget) {
+	s.Lock()
+	s.targets = append(s.targets, t)
+	s.Unlock()
+}
+
+func (s *AdminServer) getTargets() []adminTarget {
+	s.RLock()
+	defer s.RUnlock()
+	return s.targets
+}
+
+// findQueue returns the target owning the queue with the name, the name may be omitted when there is only one queue
+func (s *AdminServer) findQueue(name string) (adminTarget, string, queue, error) {
+	var (
+		target adminTarget
+		found  string
+		q      queue
+		count  int
+	)
+	for _, t := range s.getTargets() {
+		for n, tq := range t.pendingQueues() {
+			count++
+			if n == name || len(name) == 0 {
+				target, found, q = t, n, tq
+			}
+		}
+	}
+
+	if q == nil || (len(name) == 0 && count != 1) {
+		return nil, "", nil, status.Errorf(codes.NotFound, "queue %q not found", name)
+	}
+
+	return target, found, q, nil
+}
+
+// authorize checks the token of the request
+func (s *AdminServer) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(authorizationHeader) {
+		token, ok := strings.CutPrefix(v, bearerPrefix)
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+func (s *AdminServer) unaryAuth(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *AdminServer) streamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,209 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+)
+
+const testAdminToken = "secret"
+
+func newTestAdmin(t *testing.T, ctx context.Context, srv *Server, hubs ...*tap.Hub) apiV1.AdminClient {
+	t.Helper()
+
+	adm, err := NewAdminServer(ctx, &AdminConfig{
+		Host:          "127.0.0.1",
+		Token:         testAdminToken,
+		Subscriptions: []Subscription{{Topic: "home/#", QoS: 1}},
+	}, srv.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adm.SetServer(srv)
+	for _, hub := range hubs {
+		adm.SetTap(hub)
+	}
+	adm.Start()
+
+	conn, err := grpc.NewClient(adm.lst.Addr().(*net.TCPAddr).String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return apiV1.NewAdminClient(conn)
+}
+
+func TestAdminUnauthenticated(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	adm := newTestAdmin(t, ctx, srv)
+
+	for _, md := range []metadata.MD{nil, metadata.Pairs(authorizationHeader, bearerPrefix+"wrong")} {
+		_, err := adm.ListPeers(metadata.NewOutgoingContext(ctx, md), &apiV1.ListPeersRequest{})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("expected %s, got %v", codes.Unauthenticated, err)
+		}
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	adm := newTestAdmin(t, ctx, srv)
+	ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, bearerPrefix+testAdminToken)
+
+	for _, topic := range []string{"home/light", "home/door"} {
+		_ = srv.Send(&testMessage{topic: topic, payload: []byte("ON")})
+	}
+
+	subs, err := adm.ListSubscriptions(ctx, &apiV1.ListSubscriptionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs.Subscriptions) != 1 || subs.Subscriptions[0].Topic != "home/#" || subs.Subscriptions[0].Qos != 1 {
+		t.Fatalf("unexpected subscriptions %v", subs.Subscriptions)
+	}
+
+	queues, err := adm.ListQueues(ctx, &apiV1.ListQueuesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues.Queues) != 1 || queues.Queues[0].Name != "server" || queues.Queues[0].Length != 2 {
+		t.Fatalf("unexpected queues %v", queues.Queues)
+	}
+
+	dump, err := adm.DumpQueue(ctx, &apiV1.DumpQueueRequest{Name: "server", Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dump.Messages) != 1 || dump.Messages[0].Topic != "home/light" {
+		t.Fatalf("unexpected messages %v", dump.Messages)
+	}
+
+	if _, err := adm.FlushQueue(ctx, &apiV1.QueueRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected %s without peers, got %v", codes.Unavailable, err)
+	}
+
+	if _, err := adm.PurgeQueue(ctx, &apiV1.QueueRequest{Name: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected %s, got %v", codes.NotFound, err)
+	}
+
+	purged, err := adm.PurgeQueue(ctx, &apiV1.QueueRequest{Name: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged.Count != 2 || srv.queue.Len() != 0 {
+		t.Fatalf("expected 2 purged messages, got %d, left %d", purged.Count, srv.queue.Len())
+	}
+}
+
+func TestAdminPeers(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	_, uc := newTestClient(t, ctx, log, srv, &Config{Topics: []string{"home/#"}, PeerID: "home"})
+	waitPeers(t, srv, 1)
+
+	adm := newTestAdmin(t, ctx, srv)
+	ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, bearerPrefix+testAdminToken)
+
+	if err := srv.Send(&testMessage{topic: "home/light", payload: []byte("ON")}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, uc.messages, "home/light", []byte("ON"))
+
+	peers, err := adm.ListPeers(ctx, &apiV1.ListPeersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(peers.Peers))
+	}
+	p := peers.Peers[0]
+	if p.Name != "home" || len(p.Address) == 0 || p.ConnectedAt == 0 || p.MessagesSent != 1 || p.BytesSent != 2 {
+		t.Fatalf("unexpected peer %v", p)
+	}
+
+	if _, err := adm.DisconnectPeer(ctx, &apiV1.DisconnectPeerRequest{Name: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected %s, got %v", codes.NotFound, err)
+	}
+
+	resp, err := adm.DisconnectPeer(ctx, &apiV1.DisconnectPeerRequest{Id: p.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Disconnected != 1 {
+		t.Fatalf("expected 1 disconnected peer, got %d", resp.Disconnected)
+	}
+	waitPeers(t, srv, 0)
+}
+
+func TestAdminTap(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	hub := tap.New()
+	adm := newTestAdmin(t, ctx, srv, hub)
+	ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, bearerPrefix+testAdminToken)
+
+	if stream, err := adm.Tap(ctx, &apiV1.TapRequest{Direction: "both"}); err == nil {
+		if _, err = stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected %s, got %v", codes.InvalidArgument, err)
+		}
+	}
+
+	stream, err := adm.Tap(ctx, &apiV1.TapRequest{Topics: []string{"home/#"}, Direction: entity.DirectionInbound})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !hub.Active(); i++ {
+		if i == 100 {
+			t.Fatal("feed is not subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	now := time.Now()
+	hub.Publish(&tap.Event{Time: now, Direction: entity.DirectionOutbound, Topic: "home/light"})
+	hub.Publish(&tap.Event{Time: now, Direction: entity.DirectionInbound, Peer: "home", Topic: "office/light"})
+	hub.Publish(&tap.Event{Time: now, Direction: entity.DirectionInbound, Peer: "home", Topic: "home/light",
+		Payload: []byte("ON"), QoS: 1, Dropped: true, Reason: tap.ReasonEcho})
+
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Time != now.UnixNano() || e.Peer != "home" || e.Topic != "home/light" || string(e.Payload) != "ON" ||
+		e.Qos != 1 || !e.Dropped || e.Reason != tap.ReasonEcho {
+		t.Fatalf("unexpected event %v", e)
+	}
+}
+
+func TestAdminEnrollmentToken(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	adm := newTestAdmin(t, ctx, srv)
+	ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, bearerPrefix+testAdminToken)
+
+	_, err := adm.CreateEnrollmentToken(ctx, &apiV1.CreateEnrollmentTokenRequest{CommonName: "home-b"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected %s without the CA key, got %v", codes.FailedPrecondition, err)
+	}
+}
@@ -1,8 +1,15 @@
 package grpc
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,24 +20,53 @@ import (
 	apiV1 "github.com/forest33/mqtt-sync/api/v1"
 	"github.com/forest33/mqtt-sync/business/entity"
 	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+const (
+	serverPeerID = "server"
+	peerIDFile   = "peer-id"
 )
 
 type Client struct {
-	ctx    context.Context
-	cfg    *Config
-	log    *logger.Logger
-	queue  *queue
-	cli    apiV1.MqttSyncClient
-	stream apiV1.MqttSync_SyncClient
-	uc     entity.SyncUseCase
+	ctx      context.Context
+	cfg      *Config
+	log      *logger.Logger
+	queue    queue
+	outbox   *outbox
+	seq      *sequence
+	peerID   string
+	cli      apiV1.MqttSyncClient
+	stream   apiV1.MqttSync_SyncClient
+	uc       entity.SyncUseCase
+	stats    *peerStats
+	cancel   context.CancelFunc
+	connects atomic.Uint64
+	sync.Mutex
 }
 
 func NewClient(ctx context.Context, cfg *Config, log *logger.Logger) (*Client, error) {
 	c := &Client{
-		ctx:   ctx,
-		cfg:   cfg,
-		log:   log,
-		queue: newQueue(log),
+		ctx:    ctx,
+		cfg:    cfg,
+		log:    log,
+		outbox: newOutbox(serverPeerID, "", log),
+		seq:    &sequence{},
+		stats:  newPeerStats(),
+	}
+
+	var err error
+	c.queue, err = newQueue(cfg.Queue, "client", log)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.peerID, err = clientPeerID(cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.PeerID) == 0 {
+		log.Info().Str("peer_id", c.peerID).Msg("peer id is not set, using the generated one")
 	}
 
 	serverAddr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
@@ -43,8 +79,6 @@ func NewClient(ctx context.Context, cfg *Config, log *logger.Logger) (*Client, e
 		}),
 	}
 
-	opts = append(opts)
-
 	if cfg.UseTLS {
 		tlsCredentials, err := loadTLSCredentials(cfg)
 		if err != nil {
@@ -71,6 +105,8 @@ func NewClient(ctx context.Context, cfg *Config, log *logger.Logger) (*Client, e
 		if err := conn.Close(); err != nil {
 			c.log.Error().Err(err).Msg("failed to close gRPC client connection")
 		}
+		c.outbox.flush(c.queue)
+		c.queue.Close()
 		log.Info().Msg("gRPC client disconnected")
 		entity.GetWg(ctx).Done()
 	}()
@@ -78,6 +114,42 @@ func NewClient(ctx context.Context, cfg *Config, log *logger.Logger) (*Client, e
 	return c, nil
 }
 
+// clientPeerID returns the configured peer id or the generated one, the generated id is saved
+// in the directory of the persistent queue, so the server keeps the state of the client across restarts
+func clientPeerID(cfg *Config) (string, error) {
+	if len(cfg.PeerID) != 0 {
+		return cfg.PeerID, nil
+	}
+	if cfg.Queue == nil || !cfg.Queue.Persistent {
+		return newPeerID(), nil
+	}
+
+	path := filepath.Join(cfg.Queue.Dir, peerIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil && len(bytes.TrimSpace(data)) != 0 {
+		return string(bytes.TrimSpace(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id := newPeerID()
+	if err := os.MkdirAll(cfg.Queue.Dir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func newPeerID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return "mqtt-sync-" + hex.EncodeToString(b)
+}
+
 func (c *Client) SetSyncUseCase(uc entity.SyncUseCase) {
 	c.uc = uc
 }
@@ -90,12 +162,24 @@ func (c *Client) Start() error {
 		}
 	}()
 
-	c.stream, err = c.cli.Sync(c.ctx)
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	stream, err := c.cli.Sync(ctx)
 	if err != nil {
 		return err
 	}
 
-	if err := c.stream.Send(&apiV1.Message{}); err != nil {
+	if err = stream.Send(&apiV1.Message{
+		Handshake: &apiV1.Handshake{
+			Topics: c.cfg.Topics,
+			PeerId: c.peerID,
+		},
+	}); err != nil {
 		c.log.Error().Err(err).Msg("failed to send init message")
 		return err
 	}
@@ -106,7 +190,21 @@ func (c *Client) Start() error {
 		Int("port", c.cfg.Port).
 		Msg("successfully connected to gRPC server")
 
-	c.queue.Pop(c)
+	metrics.SetGRPCPeers(1)
+	if c.connects.Add(1) > 1 {
+		metrics.GRPCReconnect()
+	}
+
+	stats := newPeerStats()
+	c.Lock()
+	c.stats = stats
+	c.cancel = cancel
+	c.Unlock()
+
+	if err = c.replay(stream, stats); err != nil {
+		c.log.Error().Err(err).Msg("failed to send saved messages")
+		return err
+	}
 
 	go func() {
 		var (
@@ -115,46 +213,186 @@ func (c *Client) Start() error {
 		)
 
 		defer func() {
+			cancel()
 			if err != nil {
 				c.reconnect()
 			}
 		}()
 
 		for {
-			req, err = c.stream.Recv()
+			req, err = stream.Recv()
 			if err != nil {
 				c.log.Info().Str("reason", err.Error()).Msg("client stream broken")
+				metrics.SetGRPCPeers(0)
+				c.setStream(nil)
 				return
 			}
 
+			if req.Ack != nil {
+				c.outbox.ack(req.Ack.Seq)
+				continue
+			}
+
 			if c.uc == nil {
 				continue
 			}
 
-			c.uc.OnMessage(req.Topic, req.Payload)
+			if c.seq.duplicate(req) {
+				c.log.Debug().Uint64("seq", req.Seq).Msg("duplicate message skipped")
+			} else {
+				if err = handleMessage(c.uc, "grpc.Client.receive", serverPeerID, "", req); err != nil {
+					c.log.Error().Err(err).Uint64("seq", req.Seq).Msg("failed to handle message, resetting stream")
+					c.setStream(nil)
+					return
+				}
+				c.seq.commit(req)
+				stats.countReceived(req)
+				observeReceived(req)
+			}
+
+			if ack := newAck(req); ack != nil {
+				if err = c.sendAck(stream, ack); err != nil {
+					c.log.Error().Err(err).Msg("failed to send acknowledgement")
+					c.setStream(nil)
+					return
+				}
+			}
 		}
 	}()
 
 	return nil
 }
 
+// Send sends the message to the server, the message is queued while the stream is not available
 func (c *Client) Send(m entity.SyncMessage) (err error) {
-	err = c.send(m)
-	if err != nil {
+	m, span := startSend("grpc.Client.Send", m)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stream == nil {
+		c.queue.Push(m)
+		return entity.ErrStreamDisabled
+	}
+
+	if err := c.outbox.transmit(m, c.stats.counting(c.stream.Send)); err != nil {
+		c.stream = nil
 		c.queue.Push(m)
+		return err
 	}
-	return
+
+	return nil
 }
 
-func (c *Client) send(m entity.SyncMessage) error {
-	if c.stream == nil {
-		return entity.ErrStreamDisabled
+// replay retransmits unacknowledged messages and sends saved messages in order, the stream becomes
+// available for new messages only when the queue is empty, so new messages never overtake saved ones
+func (c *Client) replay(stream apiV1.MqttSync_SyncClient, stats *peerStats) error {
+	if err := c.outbox.retransmit(stats.counting(stream.Send)); err != nil {
+		return err
 	}
 
-	return c.stream.Send(&apiV1.Message{
-		Topic:   m.Topic(),
-		Payload: m.Payload(),
+	send := sendFunc(func(m entity.SyncMessage) error {
+		return c.outbox.transmit(m, stats.counting(stream.Send))
 	})
+
+	for {
+		if err := c.queue.Pop(send); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if c.queue.Len() == 0 {
+			c.stream = stream
+			c.Unlock()
+			return nil
+		}
+		c.Unlock()
+	}
+}
+
+// sendAck sends the acknowledgement, the stream is shared with the sender
+func (c *Client) sendAck(stream apiV1.MqttSync_SyncClient, ack *apiV1.Message) error {
+	c.Lock()
+	defer c.Unlock()
+	return stream.Send(ack)
+}
+
+// Connected reports whether the stream to the server is established
+func (c *Client) Connected() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.stream != nil
+}
+
+func (c *Client) pendingQueues() map[string]queue {
+	return map[string]queue{"client": c.queue}
+}
+
+// peerInfos returns the connection to the server
+func (c *Client) peerInfos() []*apiV1.PeerInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stream == nil {
+		return nil
+	}
+
+	info := c.stats.info()
+	info.Name = serverPeerID
+	info.Address = fmt.Sprintf("%s:%d", c.cfg.Host, c.cfg.Port)
+	info.Topics = c.cfg.Topics
+	info.Unacked = uint64(c.outbox.len())
+
+	return []*apiV1.PeerInfo{info}
+}
+
+// disconnectPeers closes the stream to the server, the client reconnects after the retry interval
+func (c *Client) disconnectPeers(id uint64, name string) int {
+	if id != 0 || name != serverPeerID {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stream == nil || c.cancel == nil {
+		return 0
+	}
+	c.cancel()
+	c.log.Info().Msg("stream to the server closed by the administrator")
+
+	return 1
+}
+
+// flushQueue sends queued messages to the server
+func (c *Client) flushQueue(_ string) (int, error) {
+	var n int
+	err := c.queue.Pop(sendFunc(func(m entity.SyncMessage) error {
+		c.Lock()
+		defer c.Unlock()
+
+		if c.stream == nil {
+			return entity.ErrStreamDisabled
+		}
+		if err := c.outbox.transmit(m, c.stats.counting(c.stream.Send)); err != nil {
+			c.stream = nil
+			return err
+		}
+		n++
+
+		return nil
+	}))
+
+	return n, err
+}
+
+func (c *Client) setStream(stream apiV1.MqttSync_SyncClient) {
+	c.Lock()
+	c.stream = stream
+	c.Unlock()
 }
 
 func (c *Client) reconnect() {
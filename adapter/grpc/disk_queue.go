@@ -0,0 +1,253 @@
+package grpc
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/seglog"
+)
+
+var errDumpLimit = errors.New("dump limit reached")
+
+// diskQueue keeps messages in order in a segment log on disk,
+// messages superseded according to the queue policy are skipped on replay
+type diskQueue struct {
+	log    *logger.Logger
+	policy *queuePolicy
+	data   *seglog.Log
+	idx    *queueIndex
+	popMu  sync.Mutex
+	sync.Mutex
+}
+
+// queueIndex tracks saved messages superseded by newer ones
+type queueIndex struct {
+	latest  map[string]uint64   // the last message of keep-last topics
+	pending map[string][]uint64 // saved messages of keep-all topics with a limit
+	skip    map[uint64]struct{} // messages over the limit of keep-all topics
+}
+
+func newDiskQueue(dir string, cfg *QueueConfig, policy *queuePolicy, log *logger.Logger) (*diskQueue, error) {
+	data, err := seglog.Open(dir, seglog.Options{
+		SegmentSize: cfg.SegmentSize,
+		MaxSize:     cfg.MaxSize,
+		MaxAge:      cfg.MaxAge,
+		DropPolicy:  seglog.DropPolicy(cfg.DropPolicy),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := &diskQueue{
+		log:    log,
+		policy: policy,
+		data:   data,
+		idx: &queueIndex{
+			latest:  make(map[string]uint64, initialQueueSize),
+			pending: make(map[string][]uint64, initialQueueSize),
+			skip:    make(map[uint64]struct{}, initialQueueSize),
+		},
+	}
+
+	if err := data.Read(func(r *seglog.Record) error {
+		req := &apiV1.Message{}
+		if err := proto.Unmarshal(r.Data, req); err == nil {
+			q.index(r.Seq, req.GetTopic())
+		}
+		return nil
+	}); err != nil {
+		_ = data.Close()
+		return nil, err
+	}
+
+	log.Info().Str("dir", dir).Int("size", data.Len()).Msg("persistent queue opened")
+
+	return q, nil
+}
+
+func (q *diskQueue) Push(m entity.SyncMessage) {
+	if mode, _ := q.policy.match(m.Topic()); mode == QueueModeDrop {
+		metrics.Dropped(metrics.DropQueuePolicy)
+		return
+	}
+
+	data, err := proto.Marshal(newProtoMessage(m))
+	if err != nil {
+		q.log.Error().Err(err).Str("topic", m.Topic()).Msg("failed to marshal message")
+		return
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	seq, err := q.data.Append(data)
+	if err != nil {
+		if errors.Is(err, seglog.ErrFull) {
+			metrics.Dropped(metrics.DropQueueFull)
+		}
+		q.log.Error().Err(err).Str("topic", m.Topic()).Msg("failed to save message to the queue")
+		return
+	}
+	q.index(seq, m.Topic())
+}
+
+// Pop sends saved messages in order until the queue is empty, messages saved in the meantime are sent too.
+// Sending stops at the first failed message, the failed and the remaining messages stay in the queue.
+func (q *diskQueue) Pop(s stream) error {
+	q.popMu.Lock()
+	defer q.popMu.Unlock()
+
+	q.log.Info().Int("size", q.data.Len()).Msg("sending saved messages from the queue")
+
+	for {
+		count, err := q.pop(s)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+	}
+}
+
+// pop sends the messages saved before the call and returns the number of removed messages
+func (q *diskQueue) pop(s stream) (int, error) {
+	var (
+		next  uint64
+		count int
+	)
+	err := q.data.Read(func(r *seglog.Record) error {
+		req := &apiV1.Message{}
+		if err := proto.Unmarshal(r.Data, req); err != nil {
+			q.log.Error().Err(err).Uint64("seq", r.Seq).Msg("failed to unmarshal saved message")
+		} else if !q.superseded(r.Seq, req.GetTopic()) {
+			if err := s.Send(newMessage(req, "")); err != nil {
+				return err
+			}
+		}
+		next = r.Seq + 1
+		count++
+		return nil
+	})
+
+	if count != 0 {
+		q.Lock()
+		if err := q.data.Truncate(next); err != nil {
+			q.log.Error().Err(err).Msg("failed to truncate queue")
+		}
+		q.prune(next)
+		q.Unlock()
+	}
+
+	return count, err
+}
+
+func (q *diskQueue) Len() int {
+	return q.data.Len()
+}
+
+// Dump returns saved messages which are not superseded in order, at most limit messages if the limit is set
+func (q *diskQueue) Dump(limit int) []entity.SyncMessage {
+	var messages []entity.SyncMessage
+	err := q.data.Read(func(r *seglog.Record) error {
+		if limit > 0 && len(messages) >= limit {
+			return errDumpLimit
+		}
+		req := &apiV1.Message{}
+		if err := proto.Unmarshal(r.Data, req); err == nil && !q.superseded(r.Seq, req.GetTopic()) {
+			messages = append(messages, newMessage(req, ""))
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDumpLimit) {
+		q.log.Error().Err(err).Msg("failed to read queue")
+	}
+
+	return messages
+}
+
+// Purge removes all saved messages and returns their number
+func (q *diskQueue) Purge() int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := q.data.Len()
+	if err := q.data.Truncate(math.MaxUint64); err != nil {
+		q.log.Error().Err(err).Msg("failed to truncate queue")
+	}
+	q.prune(math.MaxUint64)
+
+	return n
+}
+
+func (q *diskQueue) Close() {
+	if err := q.data.Close(); err != nil {
+		q.log.Error().Err(err).Msg("failed to close queue")
+	}
+}
+
+// index registers the saved message, must be called with the lock held
+func (q *diskQueue) index(seq uint64, t string) {
+	mode, limit := q.policy.match(t)
+	switch {
+	case mode == QueueModeLast:
+		q.idx.latest[t] = seq
+	case mode == QueueModeAll && limit > 0:
+		pending := append(q.idx.pending[t], seq)
+		if len(pending) > limit {
+			q.idx.skip[pending[0]] = struct{}{}
+			pending = pending[1:]
+		}
+		q.idx.pending[t] = pending
+	}
+}
+
+// superseded reports whether the saved message should not be sent according to the queue policy
+func (q *diskQueue) superseded(seq uint64, t string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	mode, _ := q.policy.match(t)
+	switch mode {
+	case QueueModeDrop:
+		return true
+	case QueueModeLast:
+		latest, ok := q.idx.latest[t]
+		return ok && latest != seq
+	}
+
+	_, ok := q.idx.skip[seq]
+	return ok
+}
+
+// prune removes sent messages from the index, must be called with the lock held
+func (q *diskQueue) prune(next uint64) {
+	for t, seq := range q.idx.latest {
+		if seq < next {
+			delete(q.idx.latest, t)
+		}
+	}
+	for t, pending := range q.idx.pending {
+		i := 0
+		for i < len(pending) && pending[i] < next {
+			i++
+		}
+		if i == len(pending) {
+			delete(q.idx.pending, t)
+		} else {
+			q.idx.pending[t] = pending[i:]
+		}
+	}
+	for seq := range q.idx.skip {
+		if seq < next {
+			delete(q.idx.skip, seq)
+		}
+	}
+}
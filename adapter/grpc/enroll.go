@@ -0,0 +1,325 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcPeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/pkg/cert"
+)
+
+const (
+	enrollSecretSize     = 16
+	enrollTokenSeparator = "."
+	enrollTimeout        = 30 * time.Second
+)
+
+var (
+	errEnrollmentDisabled = status.Error(codes.FailedPrecondition, "enrollment is disabled")
+	errInvalidToken       = status.Error(codes.PermissionDenied, "invalid or expired token")
+)
+
+// EnrollConfig server and one-time token of the client enrollment
+type EnrollConfig struct {
+	Host  string
+	Port  int
+	Token string
+}
+
+// Enrollment client certificate with its key and CA certificates of the server
+type Enrollment struct {
+	Pair *cert.Pair
+	CA   []byte
+}
+
+type enrollToken struct {
+	commonName string
+	expires    time.Time
+}
+
+// enrollment issues client certificates in exchange for one-time tokens,
+// tokens are kept in memory by the hash of the secret
+type enrollment struct {
+	ca       *cert.Pair
+	caPEM    []byte
+	validity time.Duration
+	tokens   map[string]*enrollToken
+	sync.Mutex
+}
+
+func newEnrollment(cfg *Config) (*enrollment, error) {
+	if !cfg.UseTLS {
+		return nil, errors.New("enrollment requires TLS")
+	}
+
+	ca, err := cert.Load(cfg.CACert, cfg.CAKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA key: %w", err)
+	}
+	if !ca.Cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", cfg.CACert)
+	}
+
+	caPEM, err := os.ReadFile(cfg.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	return &enrollment{
+		ca:       ca,
+		caPEM:    caPEM,
+		validity: cfg.EnrollmentValidity,
+		tokens:   make(map[string]*enrollToken),
+	}, nil
+}
+
+// createToken creates the one-time token, the token contains the fingerprint of the CA
+// so the client can verify the server before it has the CA certificate
+func (e *enrollment) createToken(commonName string, ttl time.Duration) (string, time.Time, error) {
+	secret := make([]byte, enrollSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	s := base64.RawURLEncoding.EncodeToString(secret)
+
+	now := time.Now()
+	expires := now.Add(ttl)
+
+	e.Lock()
+	defer e.Unlock()
+
+	for h, t := range e.tokens {
+		if now.After(t.expires) {
+			delete(e.tokens, h)
+		}
+	}
+	e.tokens[hashSecret(s)] = &enrollToken{commonName: commonName, expires: expires}
+
+	return s + enrollTokenSeparator + cert.Fingerprint(e.ca.Cert), expires, nil
+}
+
+// take removes the token while the certificate is issued and returns the common name of the client,
+// the token is consumed by done
+func (e *enrollment) take(token string) (string, func(issued bool), bool) {
+	secret, _, _ := strings.Cut(token, enrollTokenSeparator)
+	h := hashSecret(secret)
+
+	e.Lock()
+	t, ok := e.tokens[h]
+	delete(e.tokens, h)
+	e.Unlock()
+
+	if !ok || time.Now().After(t.expires) {
+		return "", nil, false
+	}
+
+	done := func(issued bool) {
+		if issued {
+			return
+		}
+		e.Lock()
+		e.tokens[h] = t
+		e.Unlock()
+	}
+
+	return t.commonName, done, true
+}
+
+// Enroll issues the client certificate in exchange for the one-time token,
+// the token is consumed only after the certificate has been issued
+func (s *Server) Enroll(ctx context.Context, req *apiV1.EnrollRequest) (*apiV1.EnrollResponse, error) {
+	if s.enrollment == nil {
+		return nil, errEnrollmentDisabled
+	}
+
+	cr, err := cert.ParseRequest(req.Csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid certificate signing request: %v", err)
+	}
+
+	addr := peerAddr(ctx)
+
+	cn, done, ok := s.enrollment.take(req.Token)
+	if !ok {
+		s.log.Warn().Str("address", addr).Msg("enrollment with invalid token rejected")
+		return nil, errInvalidToken
+	}
+
+	c, err := s.enrollment.ca.SignClient(cr, &cert.Request{CommonName: cn, Validity: s.enrollment.validity})
+	done(err == nil)
+	if err != nil {
+		s.log.Error().Err(err).Str("peer", cn).Str("address", addr).Msg("failed to issue client certificate")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	s.log.Info().Str("peer", cn).Str("address", addr).Time("expires", c.NotAfter).Msg("client enrolled")
+
+	return &apiV1.EnrollResponse{Certificate: cert.Encode(c), Ca: s.enrollment.caPEM}, nil
+}
+
+// createEnrollmentToken creates the one-time token for the client with the common name
+func (s *Server) createEnrollmentToken(commonName string, ttl time.Duration) (string, time.Time, error) {
+	if s.enrollment == nil {
+		return "", time.Time{}, errEnrollmentDisabled
+	}
+
+	token, expires, err := s.enrollment.createToken(commonName, ttl)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	s.log.Info().Str("peer", commonName).Time("expires", expires).Msg("enrollment token created")
+
+	return token, expires, nil
+}
+
+// Enroll generates the client key and requests the certificate from the server, the server is trusted
+// only if its certificate is issued by the CA pinned by the token, which is checked during the handshake
+// before the token is sent
+func Enroll(ctx context.Context, cfg *EnrollConfig) (*Enrollment, error) {
+	_, fingerprint, ok := strings.Cut(cfg.Token, enrollTokenSeparator)
+	if !ok || len(fingerprint) == 0 {
+		return nil, errors.New("invalid token format")
+	}
+
+	key, csr, err := cert.NewRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		// the server certificate is verified by VerifyConnection against the pinned CA
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyPinned(cs.PeerCertificates, fingerprint, cfg.Host)
+		},
+	}
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", cfg.Host, cfg.Port), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, enrollTimeout)
+	defer cancel()
+
+	resp, err := apiV1.NewMqttSyncClient(conn).Enroll(ctx, &apiV1.EnrollRequest{Token: cfg.Token, Csr: csr})
+	if err != nil {
+		return nil, err
+	}
+
+	cas, err := cert.Decode(resp.Ca)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA certificates: %w", err)
+	}
+
+	var pinned bool
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		if cert.Fingerprint(ca) == fingerprint {
+			roots.AddCert(ca)
+			pinned = true
+		}
+	}
+	if !pinned {
+		return nil, errors.New("CA of the server does not match the token")
+	}
+
+	issued, err := cert.Decode(resp.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	if _, err := issued[0].Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify client certificate: %w", err)
+	}
+	if pub, ok := issued[0].PublicKey.(interface{ Equal(x crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return nil, errors.New("client certificate does not match the key")
+	}
+
+	return &Enrollment{
+		Pair: &cert.Pair{Cert: issued[0], Key: key},
+		CA:   resp.Ca,
+	}, nil
+}
+
+// verifyPinned verifies the server certificate chain against the CA with the fingerprint,
+// the server sends the CA with its certificate when enrollment is enabled
+func verifyPinned(chain []*x509.Certificate, fingerprint, host string) error {
+	if len(chain) == 0 {
+		return errors.New("server certificate is not available")
+	}
+
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	var pinned bool
+	for _, c := range chain[1:] {
+		if cert.Fingerprint(c) == fingerprint {
+			roots.AddCert(c)
+			pinned = true
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	if !pinned {
+		return errors.New("CA of the server does not match the token")
+	}
+
+	if _, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       host,
+	}); err != nil {
+		return fmt.Errorf("failed to verify server certificate: %w", err)
+	}
+
+	return nil
+}
+
+// withCA appends the CA certificates to the certificate chain unless the chain contains them
+func withCA(chain [][]byte, caPEM []byte) ([][]byte, error) {
+	cas, err := cert.Decode(caPEM)
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range cas {
+		if !slices.ContainsFunc(chain, func(der []byte) bool { return bytes.Equal(der, ca.Raw) }) {
+			chain = append(chain, ca.Raw)
+		}
+	}
+	return chain, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// peerAddr returns the remote address of the request
+func peerAddr(ctx context.Context) string {
+	if p, ok := grpcPeer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
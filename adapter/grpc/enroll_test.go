@@ -0,0 +1,164 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/pkg/cert"
+)
+
+func TestEnroll(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srvCfg, _ := writeTestCerts(t, "home-a")
+	srvCfg.Host = "127.0.0.1"
+	srvCfg.CAKey = filepath.Join(filepath.Dir(srvCfg.CACert), "ca-key.pem")
+	srvCfg.EnrollmentValidity = time.Hour
+
+	srv, _ := newTestServer(t, ctx, log, srvCfg)
+	port := srv.lst.Addr().(*net.TCPAddr).Port
+
+	token, _, err := srv.createEnrollmentToken("home-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server is rejected during the handshake, so the token is not sent and stays valid
+	secret, _, _ := strings.Cut(token, enrollTokenSeparator)
+	if _, err := Enroll(ctx, &EnrollConfig{Host: "127.0.0.1", Port: port, Token: secret + enrollTokenSeparator + "00"}); err == nil {
+		t.Fatal("server with a CA not pinned by the token trusted")
+	}
+
+	e, err := Enroll(ctx, &EnrollConfig{Host: "127.0.0.1", Port: port, Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Enroll(ctx, &EnrollConfig{Host: "127.0.0.1", Port: port, Token: token}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected %s for the used token, got %v", codes.PermissionDenied, err)
+	}
+	if e.Pair.Cert.Subject.CommonName != "home-b" {
+		t.Fatalf("unexpected common name %s", e.Pair.Cert.Subject.CommonName)
+	}
+
+	dir := t.TempDir()
+	cliCfg := &Config{
+		UseTLS: true,
+		CACert: filepath.Join(dir, "ca-cert.pem"),
+		Cert:   filepath.Join(dir, "client-cert.pem"),
+		Key:    filepath.Join(dir, "client-key.pem"),
+	}
+	if err := e.Pair.Write(cliCfg.Cert, cliCfg.Key); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cliCfg.CACert, e.CA, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, uc := newTestClient(t, ctx, log, srv, cliCfg)
+	waitPeers(t, srv, 1)
+	if peers := srv.peerInfos(); peers[0].Name != "home-b" {
+		t.Fatalf("enrolled peer is not identified by the certificate: %s", peers[0].Name)
+	}
+	if err := srv.Send(&testMessage{topic: "home/light", payload: []byte("ON")}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, uc.messages, "home/light", []byte("ON"))
+}
+
+func TestEnrollSigningFailure(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srvCfg, _ := writeTestCerts(t, "home-a")
+	srvCfg.Host = "127.0.0.1"
+	srvCfg.CAKey = filepath.Join(filepath.Dir(srvCfg.CACert), "ca-key.pem")
+
+	srv, _ := newTestServer(t, ctx, log, srvCfg)
+
+	// the client certificate can not be issued without the common name
+	token, _, err := srv.createEnrollmentToken("", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := srv.lst.Addr().(*net.TCPAddr).Port
+
+	if _, err := Enroll(ctx, &EnrollConfig{Host: "127.0.0.1", Port: port, Token: token}); status.Code(err) != codes.Internal {
+		t.Fatalf("expected %s, got %v", codes.Internal, err)
+	}
+	if _, _, ok := srv.enrollment.take(token); !ok {
+		t.Fatal("token consumed without the issued certificate")
+	}
+}
+
+func TestSyncRequiresClientCert(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srvCfg, _ := writeTestCerts(t, "home-a")
+	srvCfg.Host = "127.0.0.1"
+	srvCfg.CAKey = filepath.Join(filepath.Dir(srvCfg.CACert), "ca-key.pem")
+
+	srv, _ := newTestServer(t, ctx, log, srvCfg)
+
+	ca, err := os.ReadFile(srvCfg.CACert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+
+	conn, err := grpc.NewClient(srv.lst.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stream, err := apiV1.NewMqttSyncClient(conn).Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestAdminEnrollmentTokenEnabled(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srvCfg, _ := writeTestCerts(t, "home-a")
+	srvCfg.Host = "127.0.0.1"
+	srvCfg.CAKey = filepath.Join(filepath.Dir(srvCfg.CACert), "ca-key.pem")
+
+	srv, _ := newTestServer(t, ctx, log, srvCfg)
+	adm := newTestAdmin(t, ctx, srv)
+	ctx = metadata.AppendToOutgoingContext(ctx, authorizationHeader, bearerPrefix+testAdminToken)
+
+	if _, err := adm.CreateEnrollmentToken(ctx, &apiV1.CreateEnrollmentTokenRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected %s without the common name, got %v", codes.InvalidArgument, err)
+	}
+
+	resp, err := adm.CreateEnrollmentToken(ctx, &apiV1.CreateEnrollmentTokenRequest{CommonName: "home-b", Ttl: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(resp.Token, enrollTokenSeparator+cert.Fingerprint(srv.enrollment.ca.Cert)) {
+		t.Fatalf("token does not pin the CA: %s", resp.Token)
+	}
+	if d := time.Until(time.Unix(0, resp.ExpiresAt)); d <= 0 || d > time.Minute {
+		t.Fatalf("unexpected token validity %v", d)
+	}
+	if cn, _, ok := srv.enrollment.take(resp.Token); !ok || cn != "home-b" {
+		t.Fatalf("token is not redeemed: %s %v", cn, ok)
+	}
+}
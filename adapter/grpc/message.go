@@ -0,0 +1,133 @@
+package grpc
+
+import (
+	"context"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+// message is a message received from the peer
+type message struct {
+	topic      string
+	payload    []byte
+	qos        byte
+	retained   bool
+	duplicate  bool
+	messageID  uint16
+	properties *entity.MessageProperties
+	ctx        context.Context
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Payload() []byte {
+	return m.payload
+}
+
+func (m *message) QoS() byte {
+	return m.qos
+}
+
+func (m *message) Retained() bool {
+	return m.retained
+}
+
+func (m *message) Duplicate() bool {
+	return m.duplicate
+}
+
+func (m *message) MessageID() uint16 {
+	return m.messageID
+}
+
+func (m *message) Properties() *entity.MessageProperties {
+	return m.properties
+}
+
+func (m *message) Context() context.Context {
+	return m.ctx
+}
+
+// newMessage converts the gRPC message to a sync message, the topic prefix is prepended to the topic
+func newMessage(req *apiV1.Message, prefix string) *message {
+	return &message{
+		topic:      prefix + req.Topic,
+		payload:    req.Payload,
+		qos:        byte(req.Qos),
+		retained:   req.Retained,
+		duplicate:  req.Duplicate,
+		messageID:  uint16(req.MessageId),
+		properties: newProperties(req.Properties),
+		ctx:        tracing.Extract(context.Background(), req.TraceContext),
+	}
+}
+
+// withTopic returns a copy of the sync message with the topic replaced
+func withTopic(m entity.SyncMessage, topic string) *message {
+	return &message{
+		topic:      topic,
+		payload:    m.Payload(),
+		qos:        m.QoS(),
+		retained:   m.Retained(),
+		duplicate:  m.Duplicate(),
+		messageID:  m.MessageID(),
+		properties: m.Properties(),
+		ctx:        entity.MessageContext(m),
+	}
+}
+
+// newProtoMessage converts a sync message to the gRPC message, payload is opaque and copied as is
+func newProtoMessage(m entity.SyncMessage) *apiV1.Message {
+	return &apiV1.Message{
+		Topic:        m.Topic(),
+		Payload:      m.Payload(),
+		Qos:          uint32(m.QoS()),
+		Retained:     m.Retained(),
+		Duplicate:    m.Duplicate(),
+		MessageId:    uint32(m.MessageID()),
+		Properties:   newProtoProperties(m.Properties()),
+		TraceContext: tracing.Inject(entity.MessageContext(m)),
+	}
+}
+
+func newProperties(p *apiV1.Properties) *entity.MessageProperties {
+	if p == nil {
+		return nil
+	}
+
+	props := &entity.MessageProperties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		MessageExpiry:   p.MessageExpiry,
+		UserProperties:  make([]entity.UserProperty, 0, len(p.UserProperties)),
+	}
+	for _, up := range p.UserProperties {
+		props.UserProperties = append(props.UserProperties, entity.UserProperty{Key: up.Key, Value: up.Value})
+	}
+
+	return props
+}
+
+func newProtoProperties(p *entity.MessageProperties) *apiV1.Properties {
+	if p == nil {
+		return nil
+	}
+
+	props := &apiV1.Properties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		MessageExpiry:   p.MessageExpiry,
+		UserProperties:  make([]*apiV1.UserProperty, 0, len(p.UserProperties)),
+	}
+	for _, up := range p.UserProperties {
+		props.UserProperties = append(props.UserProperties, &apiV1.UserProperty{Key: up.Key, Value: up.Value})
+	}
+
+	return props
+}
@@ -0,0 +1,22 @@
+package grpc
+
+import (
+	"time"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+)
+
+// observeSent counts the message sent to the peer
+func observeSent(m *apiV1.Message) {
+	metrics.Forwarded(entity.DirectionOutbound, m.Topic, len(m.Payload))
+}
+
+// observeReceived counts the message received from the peer and handled, the latency includes the clock offset of the peer
+func observeReceived(m *apiV1.Message) {
+	metrics.Forwarded(entity.DirectionInbound, m.Topic, len(m.Payload))
+	if m.Timestamp != 0 {
+		metrics.Latency(entity.DirectionInbound, time.Unix(0, m.Timestamp))
+	}
+}
@@ -17,12 +17,20 @@ type Config struct {
 	CACert                       string
 	Cert                         string
 	Key                          string
+	CAKey                        string
+	EnrollmentValidity           time.Duration
 	InsecureSkipVerify           bool
 	ConnectRetryInterval         time.Duration
 	KeepalivePingMinTime         int
 	KeepaliveTime                int
 	KeepaliveTimeout             int
 	KeepalivePermitWithoutStream bool
+	Topics                       []string
+	PeerID                       string
+	PeerIDSource                 string
+	TopicPrefix                  string
+	Reflection                   bool
+	Queue                        *QueueConfig
 }
 
 func loadTLSCredentials(cfg *Config) (credentials.TransportCredentials, error) {
@@ -51,12 +59,24 @@ func loadTLSCredentials(cfg *Config) (credentials.TransportCredentials, error) {
 		return nil, err
 	}
 
+	// the same settings are used by the server and the client, the client verifies the server by RootCAs
 	tlsConfig := &tls.Config{
 		Certificates:       []tls.Certificate{serverCert},
 		ClientAuth:         tls.RequireAndVerifyClientCert,
 		ClientCAs:          certPool,
+		RootCAs:            certPool,
 		InsecureSkipVerify: cfg.InsecureSkipVerify,
 	}
 
+	// clients without a certificate may only enroll, the sync stream requires the certificate,
+	// the CA is sent with the server certificate, so enrolling clients can check it against the token
+	if len(cfg.CAKey) != 0 {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if serverCert.Certificate, err = withCA(serverCert.Certificate, ca); err != nil {
+			return nil, fmt.Errorf("failed to add CA certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{serverCert}
+	}
+
 	return credentials.NewTLS(tlsConfig), nil
 }
@@ -0,0 +1,139 @@
+package grpc
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+)
+
+const (
+	outboxSize = 10000
+)
+
+// outbox keeps messages sent to the peer until the peer acknowledges them
+type outbox struct {
+	log     *logger.Logger
+	name    string
+	prefix  string
+	epoch   uint64
+	lastSeq uint64
+	pending *list.List
+	index   map[uint64]*list.Element
+	sync.Mutex
+}
+
+func newOutbox(name, prefix string, log *logger.Logger) *outbox {
+	return &outbox{
+		log:     log,
+		name:    name,
+		prefix:  prefix,
+		epoch:   uint64(time.Now().UnixNano()),
+		pending: list.New(),
+		index:   make(map[uint64]*list.Element, initialQueueSize),
+	}
+}
+
+// add assigns the next sequence number to the message and keeps it until it is acknowledged,
+// the oldest message is dropped when the outbox is full
+func (o *outbox) add(m *apiV1.Message) *apiV1.Message {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.pending.Len() >= outboxSize {
+		oldest := o.pending.Remove(o.pending.Front()).(*apiV1.Message)
+		delete(o.index, oldest.Seq)
+		metrics.Dropped(metrics.DropOutboxFull)
+		o.log.Warn().Str("peer", o.name).Uint64("seq", oldest.Seq).Str("topic", oldest.Topic).Msg("unacknowledged message dropped")
+	}
+
+	o.lastSeq++
+	m.Seq = o.lastSeq
+	m.Epoch = o.epoch
+	m.Timestamp = time.Now().UnixNano()
+	o.index[m.Seq] = o.pending.PushBack(m)
+
+	return m
+}
+
+// len returns the number of messages waiting for acknowledgement
+func (o *outbox) len() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.pending.Len()
+}
+
+// ack removes acknowledged messages
+func (o *outbox) ack(seqs []uint64) {
+	o.Lock()
+	defer o.Unlock()
+
+	for _, seq := range seqs {
+		if e, ok := o.index[seq]; ok {
+			o.pending.Remove(e)
+			delete(o.index, seq)
+		}
+	}
+}
+
+// remove removes the message which has not been sent
+func (o *outbox) remove(m *apiV1.Message) {
+	o.ack([]uint64{m.Seq})
+}
+
+// unacked returns messages waiting for acknowledgement in sequence order
+func (o *outbox) unacked() []*apiV1.Message {
+	o.Lock()
+	defer o.Unlock()
+
+	messages := make([]*apiV1.Message, 0, o.pending.Len())
+	for e := o.pending.Front(); e != nil; e = e.Next() {
+		messages = append(messages, e.Value.(*apiV1.Message))
+	}
+
+	return messages
+}
+
+// retransmit sends messages waiting for acknowledgement again with the same sequence numbers
+func (o *outbox) retransmit(send func(m *apiV1.Message) error) error {
+	messages := o.unacked()
+	if len(messages) != 0 {
+		o.log.Info().Str("peer", o.name).Int("size", len(messages)).Msg("retransmitting unacknowledged messages")
+	}
+
+	for _, m := range messages {
+		if err := send(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flush moves messages waiting for acknowledgement to the queue
+func (o *outbox) flush(q queue) {
+	for _, m := range o.unacked() {
+		q.Push(newMessage(m, o.prefix))
+	}
+
+	o.Lock()
+	o.pending.Init()
+	clear(o.index)
+	o.Unlock()
+}
+
+// transmit sends the message with the next sequence number,
+// the message is removed from the outbox if it could not be sent
+func (o *outbox) transmit(m entity.SyncMessage, send func(m *apiV1.Message) error) error {
+	msg := o.add(newProtoMessage(m))
+	if err := send(msg); err != nil {
+		o.remove(msg)
+		return err
+	}
+	observeSent(msg)
+	return nil
+}
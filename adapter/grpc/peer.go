@@ -0,0 +1,302 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/credentials"
+	grpcPeer "google.golang.org/grpc/peer"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	peerQueueSize = 1000
+
+	peerIDSourceAuto      = "auto"
+	peerIDSourceCert      = "cert"
+	peerIDSourceHandshake = "handshake"
+
+	topicPrefixPeerPlaceholder = "{peer}"
+)
+
+var peerIDReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// peer is a client connected to the server
+type peer struct {
+	id        uint64
+	name      string
+	anonymous bool
+	addr      string
+	prefix    string
+	topics    []string
+	stream    apiV1.MqttSync_SyncServer
+	outbox    *outbox
+	queue     queue
+	messages  chan entity.SyncMessage
+	saved     atomic.Bool
+	log       *logger.Logger
+	stats     *peerStats
+	sendMu    sync.Mutex
+
+	disconnected   chan struct{}
+	disconnectOnce sync.Once
+}
+
+func newPeer(id uint64, stream apiV1.MqttSync_SyncServer, handshake *apiV1.Handshake, cfg *Config, log *logger.Logger) *peer {
+	p := &peer{
+		id:       id,
+		topics:   handshake.GetTopics(),
+		stream:   stream,
+		messages: make(chan entity.SyncMessage, peerQueueSize),
+		log:      log,
+		stats:    newPeerStats(),
+
+		disconnected: make(chan struct{}),
+	}
+
+	if gp, ok := grpcPeer.FromContext(stream.Context()); ok {
+		p.addr = gp.Addr.String()
+	}
+
+	p.name = peerName(stream.Context(), handshake, cfg.PeerIDSource)
+	if len(p.name) == 0 {
+		p.name = p.addr
+		p.anonymous = true
+	}
+
+	if len(cfg.TopicPrefix) != 0 {
+		p.prefix = strings.ReplaceAll(cfg.TopicPrefix, topicPrefixPeerPlaceholder, peerIDReplacer.Replace(p.name))
+	}
+
+	return p
+}
+
+// peerName returns the peer identity from the client certificate or the handshake
+func peerName(ctx context.Context, handshake *apiV1.Handshake, source string) string {
+	if source == peerIDSourceHandshake {
+		return handshake.GetPeerId()
+	}
+
+	if name := certName(ctx); len(name) != 0 || source == peerIDSourceCert {
+		return name
+	}
+
+	return handshake.GetPeerId()
+}
+
+// certName returns the common name or the first DNS name of the verified client certificate
+func certName(ctx context.Context) string {
+	cert := verifiedCert(ctx)
+	if cert == nil {
+		return ""
+	}
+
+	if len(cert.Subject.CommonName) != 0 {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) != 0 {
+		return cert.DNSNames[0]
+	}
+
+	return ""
+}
+
+// verifiedCert returns the verified client certificate
+func verifiedCert(ctx context.Context) *x509.Certificate {
+	gp, ok := grpcPeer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	tlsInfo, ok := gp.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+// accept reports whether the peer is interested in the topic
+func (p *peer) accept(t string) bool {
+	return len(p.topics) == 0 || topic.MatchAny(p.topics, t)
+}
+
+// Send puts the message into the peer queue, messages the peer is not interested in are skipped,
+// the message is saved in the queue of the peer identity when the peer queue is full
+func (p *peer) Send(m entity.SyncMessage) error {
+	m, ok := p.prepare(m)
+	if !ok {
+		return nil
+	}
+
+	select {
+	case p.messages <- m:
+	default:
+		p.log.Debug().Str("peer", p.name).Str("topic", m.Topic()).Msg("peer queue is full, message saved")
+		p.queue.Push(p.restore(m))
+		p.saved.Store(true)
+	}
+
+	return nil
+}
+
+// prepare removes the peer topic prefix from the topic,
+// returns false for messages without the prefix or the peer is not interested in
+func (p *peer) prepare(m entity.SyncMessage) (entity.SyncMessage, bool) {
+	if len(p.prefix) != 0 {
+		if !strings.HasPrefix(m.Topic(), p.prefix) {
+			return nil, false
+		}
+		m = withTopic(m, strings.TrimPrefix(m.Topic(), p.prefix))
+	}
+
+	return m, p.accept(m.Topic())
+}
+
+// replay sends messages saved in the queue of the peer identity directly to the stream
+func (p *peer) replay(m entity.SyncMessage) error {
+	m, ok := p.prepare(m)
+	if !ok {
+		return nil
+	}
+	return p.outbox.transmit(m, p.send)
+}
+
+// take sends messages saved in the shared queue the peer is interested in,
+// other messages are saved back in the shared queue for the other peers
+func (p *peer) take(shared queue) error {
+	var rejected []entity.SyncMessage
+	err := shared.Pop(sendFunc(func(m entity.SyncMessage) error {
+		pm, ok := p.prepare(m)
+		if !ok {
+			rejected = append(rejected, m)
+			return nil
+		}
+		return p.outbox.transmit(pm, p.send)
+	}))
+
+	for _, m := range rejected {
+		shared.Push(m)
+	}
+
+	return err
+}
+
+// send sends the message to the stream, the stream is shared by the sender and the acknowledgements
+func (p *peer) send(m *apiV1.Message) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	if err := p.stream.Send(m); err != nil {
+		return err
+	}
+	p.stats.countSent(m)
+
+	return nil
+}
+
+// disconnect closes the stream of the peer
+func (p *peer) disconnect() {
+	p.disconnectOnce.Do(func() {
+		close(p.disconnected)
+	})
+}
+
+// info returns the peer info
+func (p *peer) info() *apiV1.PeerInfo {
+	info := p.stats.info()
+	info.Id = p.id
+	info.Name = p.name
+	info.Address = p.addr
+	info.TopicPrefix = p.prefix
+	info.Topics = p.topics
+	if p.outbox != nil {
+		info.Unacked = uint64(p.outbox.len())
+	}
+	return info
+}
+
+// run sends unacknowledged messages, messages saved in the shared queue and in the queue of the peer identity
+// and then queued messages to the peer until the stream is closed, unsent messages are saved in the queue of the peer identity
+func (p *peer) run(ctx context.Context, shared queue) {
+	if err := p.outbox.retransmit(p.send); err != nil {
+		p.fail(ctx, err, "failed to retransmit messages")
+		return
+	}
+
+	if err := p.take(shared); err != nil {
+		p.fail(ctx, err, "failed to send saved messages")
+		return
+	}
+
+	if p.queue != shared {
+		if err := p.queue.Pop(sendFunc(p.replay)); err != nil {
+			p.fail(ctx, err, "failed to send saved messages")
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.drain()
+			return
+		case m := <-p.messages:
+			if err := p.outbox.transmit(m, p.send); err != nil {
+				p.queue.Push(p.restore(m))
+				p.fail(ctx, err, "failed to send message")
+				return
+			}
+		}
+
+		// messages saved while the peer queue was full are sent once it is empty
+		if len(p.messages) == 0 && p.saved.Swap(false) {
+			if err := p.resend(shared); err != nil {
+				p.fail(ctx, err, "failed to send saved messages")
+				return
+			}
+		}
+	}
+}
+
+// resend sends messages saved in the queue of the peer, the peer without identity takes them from the shared queue
+func (p *peer) resend(shared queue) error {
+	if p.queue == shared {
+		return p.take(shared)
+	}
+	return p.queue.Pop(sendFunc(p.replay))
+}
+
+// fail logs the error and saves queued messages when the stream is closed
+func (p *peer) fail(ctx context.Context, err error, msg string) {
+	p.log.Error().Err(err).Str("peer", p.name).Msg(msg)
+	<-ctx.Done()
+	p.drain()
+}
+
+// drain saves queued messages in the queue of the peer identity
+func (p *peer) drain() {
+	for {
+		select {
+		case m := <-p.messages:
+			p.queue.Push(p.restore(m))
+		default:
+			return
+		}
+	}
+}
+
+// restore adds the peer topic prefix back to the message
+func (p *peer) restore(m entity.SyncMessage) entity.SyncMessage {
+	if len(p.prefix) == 0 {
+		return m
+	}
+	return withTopic(m, p.prefix+m.Topic())
+}
@@ -1,51 +1,235 @@
 package grpc
 
 import (
-	"maps"
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/forest33/mqtt-sync/business/entity"
 	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/seglog"
 )
 
 const (
 	initialQueueSize = 10
+	// memoryQueueLimit messages per topic kept by the memory queue in mode all without the limit
+	memoryQueueLimit = 1000
 )
 
-type queue struct {
-	log      *logger.Logger
-	messages map[string]entity.SyncMessage
-	sync.Mutex
+// queue keeps messages which could not be sent to the peer
+type queue interface {
+	Push(m entity.SyncMessage)
+	Pop(s stream) error
+	Len() int
+	Dump(limit int) []entity.SyncMessage
+	Purge() int
+	Close()
 }
 
 type stream interface {
 	Send(m entity.SyncMessage) (err error)
 }
 
-func newQueue(log *logger.Logger) *queue {
-	return &queue{
+// sendFunc adapts a send function to the stream interface
+type sendFunc func(m entity.SyncMessage) error
+
+func (f sendFunc) Send(m entity.SyncMessage) error {
+	return f(m)
+}
+
+// QueueConfig outbound queue settings
+type QueueConfig struct {
+	Persistent  bool
+	Dir         string
+	SegmentSize int64
+	MaxSize     int64
+	MaxAge      time.Duration
+	DropPolicy  string
+	DefaultMode string
+	Policies    []QueuePolicy
+}
+
+// ValidateQueueConfig checks the queue settings without creating the queue
+func ValidateQueueConfig(cfg *QueueConfig) error {
+	if _, err := newQueuePolicy(cfg.Policies, cfg.defaultMode()); err != nil {
+		return err
+	}
+	if cfg.Persistent && cfg.DropPolicy != string(seglog.DropOldest) && cfg.DropPolicy != string(seglog.DropNewest) {
+		return fmt.Errorf("unknown queue drop policy %q", cfg.DropPolicy)
+	}
+	return nil
+}
+
+// defaultMode returns the queue mode of topics without a policy
+func (cfg *QueueConfig) defaultMode() string {
+	if len(cfg.DefaultMode) != 0 {
+		return cfg.DefaultMode
+	}
+	if cfg.Persistent {
+		return QueueModeAll
+	}
+	return QueueModeLast
+}
+
+func newQueue(cfg *QueueConfig, name string, log *logger.Logger) (queue, error) {
+	if cfg == nil {
+		cfg = &QueueConfig{}
+	}
+
+	policy, err := newQueuePolicy(cfg.Policies, cfg.defaultMode())
+	if err != nil {
+		return nil, err
+	}
+
+	var q queue
+	if !cfg.Persistent {
+		q = newMemoryQueue(policy, log)
+	} else if q, err = newDiskQueue(filepath.Join(cfg.Dir, name), cfg, policy, log); err != nil {
+		return nil, err
+	}
+
+	metrics.RegisterQueue(name, q.Len)
+
+	return &measuredQueue{queue: q, name: name}, nil
+}
+
+// measuredQueue removes the queue depth metric when the queue is closed
+type measuredQueue struct {
+	queue
+	name string
+}
+
+func (q *measuredQueue) Close() {
+	metrics.UnregisterQueue(q.name)
+	q.queue.Close()
+}
+
+// memoryQueue keeps messages in memory in arrival order according to the queue policy
+type memoryQueue struct {
+	log      *logger.Logger
+	policy   *queuePolicy
+	messages *list.List
+	topics   map[string][]*list.Element
+	popMu    sync.Mutex
+	sync.Mutex
+}
+
+func newMemoryQueue(policy *queuePolicy, log *logger.Logger) *memoryQueue {
+	return &memoryQueue{
 		log:      log,
-		messages: make(map[string]entity.SyncMessage, initialQueueSize),
+		policy:   policy,
+		messages: list.New(),
+		topics:   make(map[string][]*list.Element, initialQueueSize),
 	}
 }
 
-func (q *queue) Push(message entity.SyncMessage) {
+// Push appends the message to the queue, older messages of the topic over the policy limit are removed,
+// at most memoryQueueLimit messages of the topic are kept when the limit is not set
+func (q *memoryQueue) Push(m entity.SyncMessage) {
+	mode, limit := q.policy.match(m.Topic())
+	switch mode {
+	case QueueModeDrop:
+		metrics.Dropped(metrics.DropQueuePolicy)
+		return
+	case QueueModeLast:
+		limit = 1
+	case QueueModeAll:
+		if limit == 0 {
+			limit = memoryQueueLimit
+		}
+	}
+
 	q.Lock()
-	q.messages[message.Topic()] = message
-	q.Unlock()
+	defer q.Unlock()
+
+	elements := append(q.topics[m.Topic()], q.messages.PushBack(m))
+	if len(elements) > limit {
+		for _, e := range elements[:len(elements)-limit] {
+			q.messages.Remove(e)
+			metrics.Dropped(metrics.DropQueuePolicy)
+		}
+		elements = slices.Clone(elements[len(elements)-limit:])
+	}
+	q.topics[m.Topic()] = elements
 }
 
-func (q *queue) Pop(s stream) {
-	q.Lock()
-	messages := maps.Clone(q.messages)
-	clear(q.messages)
-	q.Unlock()
+// Pop sends queued messages in arrival order until the queue is empty, messages queued
+// in the meantime are sent too. Sending stops at the first failed message,
+// the failed and the remaining messages stay in the queue.
+func (q *memoryQueue) Pop(s stream) error {
+	q.popMu.Lock()
+	defer q.popMu.Unlock()
+
+	q.log.Info().Int("size", q.Len()).Msg("sending saved messages from the queue")
 
-	q.log.Info().Int("size", len(messages)).Msg("sending saved messages from the queue")
+	for {
+		q.Lock()
+		e := q.messages.Front()
+		q.Unlock()
 
-	for k := range messages {
-		if err := s.Send(messages[k]); err != nil {
-			q.log.Error().Err(err).Msg("failed to send message")
+		if e == nil {
+			return nil
 		}
+
+		if err := s.Send(e.Value.(entity.SyncMessage)); err != nil {
+			return err
+		}
+
+		q.Lock()
+		q.remove(e)
+		q.Unlock()
 	}
 }
+
+func (q *memoryQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.messages.Len()
+}
+
+// Dump returns queued messages in arrival order, at most limit messages if the limit is set
+func (q *memoryQueue) Dump(limit int) []entity.SyncMessage {
+	q.Lock()
+	defer q.Unlock()
+
+	messages := make([]entity.SyncMessage, 0, q.messages.Len())
+	for e := q.messages.Front(); e != nil && (limit <= 0 || len(messages) < limit); e = e.Next() {
+		messages = append(messages, e.Value.(entity.SyncMessage))
+	}
+
+	return messages
+}
+
+// Purge removes all queued messages and returns their number
+func (q *memoryQueue) Purge() int {
+	q.Lock()
+	defer q.Unlock()
+
+	n := q.messages.Len()
+	q.messages.Init()
+	clear(q.topics)
+
+	return n
+}
+
+// remove removes the sent message unless it has been superseded while sending, must be called with the lock held
+func (q *memoryQueue) remove(e *list.Element) {
+	t := e.Value.(entity.SyncMessage).Topic()
+	i := slices.Index(q.topics[t], e)
+	if i < 0 {
+		return
+	}
+
+	q.messages.Remove(e)
+	if elements := slices.Delete(q.topics[t], i, i+1); len(elements) != 0 {
+		q.topics[t] = elements
+	} else {
+		delete(q.topics, t)
+	}
+}
+
+func (q *memoryQueue) Close() {}
@@ -0,0 +1,67 @@
+package grpc
+
+import (
+	"fmt"
+
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	QueueModeLast = "last"
+	QueueModeAll  = "all"
+	QueueModeDrop = "drop"
+)
+
+// QueuePolicy defines how messages matching the topic filter are queued while the peer is unavailable
+type QueuePolicy struct {
+	Topic string
+	Mode  string
+	Limit int
+}
+
+// queuePolicy resolves the queue mode for a topic, the first matching rule wins
+type queuePolicy struct {
+	rules       []QueuePolicy
+	defaultMode string
+}
+
+func newQueuePolicy(rules []QueuePolicy, defaultMode string) (*queuePolicy, error) {
+	if err := checkQueueMode(defaultMode); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		if err := topic.Validate(r.Topic); err != nil {
+			return nil, fmt.Errorf("queue policy: %w", err)
+		}
+		if err := checkQueueMode(r.Mode); err != nil {
+			return nil, fmt.Errorf("%w for topic %s", err, r.Topic)
+		}
+		if r.Limit < 0 {
+			return nil, fmt.Errorf("invalid queue limit %d for topic %s", r.Limit, r.Topic)
+		}
+	}
+
+	return &queuePolicy{
+		rules:       rules,
+		defaultMode: defaultMode,
+	}, nil
+}
+
+// match returns the queue mode and the per topic limit of queued messages, zero limit means no limit
+func (p *queuePolicy) match(t string) (string, int) {
+	for _, r := range p.rules {
+		if topic.Match(r.Topic, t) {
+			return r.Mode, r.Limit
+		}
+	}
+	return p.defaultMode, 0
+}
+
+func checkQueueMode(mode string) error {
+	switch mode {
+	case QueueModeLast, QueueModeAll, QueueModeDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown queue mode %q", mode)
+}
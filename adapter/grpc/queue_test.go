@@ -0,0 +1,230 @@
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+)
+
+var errTestSend = errors.New("send failed")
+
+// testStream records sent messages, fails after failAfter messages when failAfter is positive
+// and calls onSend before every message
+type testStream struct {
+	sent      []string
+	failAfter int
+	onSend    func(n int)
+}
+
+func (s *testStream) Send(m entity.SyncMessage) error {
+	if s.onSend != nil {
+		s.onSend(len(s.sent))
+	}
+	if s.failAfter > 0 && len(s.sent) == s.failAfter {
+		return errTestSend
+	}
+	s.sent = append(s.sent, fmt.Sprintf("%s=%s", m.Topic(), m.Payload()))
+	return nil
+}
+
+var testQueuePolicies = []QueuePolicy{
+	{Topic: "z2m/+/state", Mode: QueueModeLast},
+	{Topic: "z2m/+/action", Mode: QueueModeAll, Limit: 2},
+	{Topic: "z2m/bridge/#", Mode: QueueModeDrop},
+}
+
+func TestQueuePolicy(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, persistent bool) {
+		q := newTestQueue(t, persistent, QueueModeAll)
+
+		for i := 0; i < 3; i++ {
+			pushTestMessage(q, "z2m/lamp/state", i)
+			pushTestMessage(q, "z2m/button/action", i)
+			pushTestMessage(q, "z2m/bridge/logging", i)
+			pushTestMessage(q, "z2m/other", i)
+		}
+
+		expectPop(t, q, &testStream{},
+			"z2m/other=0", "z2m/button/action=1", "z2m/other=1",
+			"z2m/lamp/state=2", "z2m/button/action=2", "z2m/other=2")
+		expectPop(t, q, &testStream{})
+	})
+}
+
+func TestQueueOrder(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, persistent bool) {
+		q := newTestQueue(t, persistent, QueueModeAll)
+
+		pushTestMessage(q, "z2m/lamp", 1)
+		pushTestMessage(q, "z2m/socket", 1)
+		pushTestMessage(q, "z2m/lamp", 0)
+		pushTestMessage(q, "z2m/socket", 0)
+
+		expectPop(t, q, &testStream{}, "z2m/lamp=1", "z2m/socket=1", "z2m/lamp=0", "z2m/socket=0")
+	})
+}
+
+func TestQueueCoalescing(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, persistent bool) {
+		q := newTestQueue(t, persistent, QueueModeLast)
+
+		pushTestMessage(q, "z2m/lamp", 1)
+		pushTestMessage(q, "z2m/socket", 1)
+		pushTestMessage(q, "z2m/lamp", 0)
+		pushTestMessage(q, "z2m/sensor", 21)
+
+		// the last message of the topic takes the position of its arrival
+		expectPop(t, q, &testStream{}, "z2m/socket=1", "z2m/lamp=0", "z2m/sensor=21")
+	})
+}
+
+func TestQueueSendFailure(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, persistent bool) {
+		q := newTestQueue(t, persistent, QueueModeAll)
+
+		for i := 0; i < 5; i++ {
+			pushTestMessage(q, "z2m/events", i)
+		}
+
+		s := &testStream{failAfter: 2}
+		if err := q.Pop(s); !errors.Is(err, errTestSend) {
+			t.Fatalf("expected send error, got %v", err)
+		}
+		if !slices.Equal(s.sent, []string{"z2m/events=0", "z2m/events=1"}) {
+			t.Fatalf("unexpected messages %v", s.sent)
+		}
+		if q.Len() != 3 {
+			t.Fatalf("unexpected queue length %d", q.Len())
+		}
+
+		pushTestMessage(q, "z2m/events", 5)
+
+		expectPop(t, q, &testStream{},
+			"z2m/events=2", "z2m/events=3", "z2m/events=4", "z2m/events=5")
+	})
+}
+
+func TestQueuePushWhilePop(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, persistent bool) {
+		q := newTestQueue(t, persistent, QueueModeLast)
+
+		pushTestMessage(q, "z2m/lamp", 1)
+		pushTestMessage(q, "z2m/socket", 1)
+
+		s := &testStream{
+			onSend: func(n int) {
+				if n == 0 {
+					pushTestMessage(q, "z2m/socket", 0)
+					pushTestMessage(q, "z2m/lamp", 0)
+				}
+			},
+		}
+
+		// the superseded message is skipped, messages queued while sending are sent in order
+		expectPop(t, q, s, "z2m/lamp=1", "z2m/socket=0", "z2m/lamp=0")
+		if q.Len() != 0 {
+			t.Fatalf("unexpected queue length %d", q.Len())
+		}
+	})
+}
+
+func TestQueueReopen(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &QueueConfig{
+		Persistent: true,
+		Dir:        dir,
+		DropPolicy: "oldest",
+		Policies:   testQueuePolicies,
+	}
+	log := logger.New(logger.Config{Level: "disabled"})
+
+	q, err := newQueue(cfg, "test", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		pushTestMessage(q, "z2m/lamp/state", i)
+		pushTestMessage(q, "z2m/button/action", i)
+	}
+	q.Close()
+
+	q, err = newQueue(cfg, "test", log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Close)
+
+	expectPop(t, q, &testStream{}, "z2m/button/action=1", "z2m/lamp/state=2", "z2m/button/action=2")
+}
+
+func TestQueuePolicyInvalid(t *testing.T) {
+	if _, err := newQueuePolicy([]QueuePolicy{{Topic: "a/#", Mode: "fifo"}}, QueueModeLast); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+	if _, err := newQueuePolicy([]QueuePolicy{{Topic: "a/#", Mode: QueueModeAll, Limit: -1}}, QueueModeLast); err == nil {
+		t.Fatal("expected error for negative limit")
+	}
+	if _, err := newQueuePolicy([]QueuePolicy{{Topic: "a/#/b", Mode: QueueModeAll}}, QueueModeLast); err == nil {
+		t.Fatal("expected error for invalid topic filter")
+	}
+}
+
+func TestMemoryQueueLimit(t *testing.T) {
+	q := newTestQueue(t, false, QueueModeAll)
+
+	for i := 0; i < memoryQueueLimit+10; i++ {
+		pushTestMessage(q, "z2m/other", i)
+	}
+
+	if n := q.Len(); n != memoryQueueLimit {
+		t.Fatalf("expected %d queued messages, got %d", memoryQueueLimit, n)
+	}
+	if m := q.Dump(1); string(m[0].Payload()) != "10" {
+		t.Fatalf("expected the oldest messages to be dropped, got %s", m[0].Payload())
+	}
+}
+
+func forEachQueue(t *testing.T, f func(t *testing.T, persistent bool)) {
+	for _, persistent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("persistent=%v", persistent), func(t *testing.T) {
+			f(t, persistent)
+		})
+	}
+}
+
+func expectPop(t *testing.T, q queue, s *testStream, want ...string) {
+	t.Helper()
+
+	if err := q.Pop(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.sent) != len(want) || (len(want) != 0 && !slices.Equal(s.sent, want)) {
+		t.Fatalf("unexpected messages %v, want %v", s.sent, want)
+	}
+}
+
+func newTestQueue(t *testing.T, persistent bool, defaultMode string) queue {
+	t.Helper()
+
+	q, err := newQueue(&QueueConfig{
+		Persistent:  persistent,
+		Dir:         t.TempDir(),
+		DropPolicy:  "oldest",
+		DefaultMode: defaultMode,
+		Policies:    testQueuePolicies,
+	}, "test", logger.New(logger.Config{Level: "disabled"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Close)
+
+	return q
+}
+
+func pushTestMessage(q queue, topic string, i int) {
+	q.Push(&testMessage{topic: topic, payload: []byte(fmt.Sprint(i))})
+}
@@ -0,0 +1,54 @@
+package grpc
+
+import (
+	"sync"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+)
+
+// sequence tracks the last message published from the sender to detect retransmitted duplicates.
+// Messages are published in order and a failed publish resets the stream,
+// so every message with a lower sequence number has already been published.
+type sequence struct {
+	epoch   uint64
+	lastSeq uint64
+	sync.Mutex
+}
+
+// duplicate reports whether the message has already been published
+func (s *sequence) duplicate(m *apiV1.Message) bool {
+	if m.Seq == 0 {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return m.Epoch == s.epoch && m.Seq <= s.lastSeq
+}
+
+// commit marks the message as published
+func (s *sequence) commit(m *apiV1.Message) {
+	if m.Seq == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if m.Epoch != s.epoch {
+		s.epoch = m.Epoch
+		s.lastSeq = 0
+	}
+	if m.Seq > s.lastSeq {
+		s.lastSeq = m.Seq
+	}
+}
+
+// newAck returns the acknowledgement of the message, nil when the sender does not expect it
+func newAck(m *apiV1.Message) *apiV1.Message {
+	if m.Seq == 0 {
+		return nil
+	}
+	return &apiV1.Message{Ack: &apiV1.Ack{Seq: []uint64{m.Seq}}}
+}
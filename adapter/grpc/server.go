@@ -1,44 +1,78 @@
 package grpc
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	apiV1 "github.com/forest33/mqtt-sync/api/v1"
 	"github.com/forest33/mqtt-sync/business/entity"
 	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+const (
+	// syncServiceName name of the sync service reported by the health service
+	syncServiceName = "mqtt_sync_service.v1.MqttSync"
 )
 
 type Server struct {
-	ctx    context.Context
-	cfg    *Config
-	log    *logger.Logger
-	queue  *queue
-	lst    net.Listener
-	srv    *grpc.Server
-	uc     entity.SyncUseCase
-	stream apiV1.MqttSync_SyncServer
+	ctx        context.Context
+	cfg        *Config
+	log        *logger.Logger
+	queue      queue
+	lst        net.Listener
+	srv        *grpc.Server
+	health     *health.Server
+	uc         entity.SyncUseCase
+	peers      map[uint64]*peer
+	outboxes   map[string]*outbox
+	sequences  map[string]*sequence
+	queues     map[string]queue
+	online     map[string]int
+	enrollment *enrollment
+	lastID     atomic.Uint64
+	serving    atomic.Bool
+	sync.RWMutex
 }
 
 func NewServer(ctx context.Context, cfg *Config, log *logger.Logger) (*Server, error) {
 	s := &Server{
-		ctx:   ctx,
-		cfg:   cfg,
-		log:   log,
-		queue: newQueue(log),
+		ctx:       ctx,
+		cfg:       cfg,
+		log:       log,
+		peers:     make(map[uint64]*peer),
+		outboxes:  make(map[string]*outbox),
+		sequences: make(map[string]*sequence),
+		queues:    make(map[string]queue),
+		online:    make(map[string]int),
 	}
 
 	var err error
+	s.queue, err = newQueue(cfg.Queue, "server", log)
+	if err != nil {
+		return nil, err
+	}
+
 	s.lst, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
 	if err != nil {
 		return nil, err
@@ -63,13 +97,34 @@ func NewServer(ctx context.Context, cfg *Config, log *logger.Logger) (*Server, e
 		opts = append(opts, grpc.Creds(tlsCredentials))
 	}
 
+	if len(cfg.CAKey) != 0 {
+		if s.enrollment, err = newEnrollment(cfg); err != nil {
+			return nil, err
+		}
+		log.Info().Msg("client enrollment enabled")
+	}
+
 	s.srv = grpc.NewServer(opts...)
 	apiV1.RegisterMqttSyncServer(s.srv, s)
 
+	// the sync service is not serving until the MQTT client is connected
+	s.health = health.NewServer()
+	s.SetServing(false)
+	healthpb.RegisterHealthServer(s.srv, s.health)
+
+	if cfg.Reflection {
+		reflection.Register(s.srv)
+		log.Info().Msg("gRPC server reflection enabled")
+	}
+
 	entity.GetWg(ctx).Add(1)
 	go func() {
 		<-ctx.Done()
+		s.serving.Store(false)
+		s.health.Shutdown()
 		s.srv.GracefulStop()
+		s.flush()
+		s.closeQueues()
 		s.log.Info().Msg("gRPC server stopped")
 		entity.GetWg(ctx).Done()
 	}()
@@ -87,6 +142,7 @@ func (s *Server) Start() {
 		Str("host", s.cfg.Host).
 		Int("port", s.cfg.Port).
 		Msg("gRPC server started")
+	s.serving.Store(true)
 	go func() {
 		if err := s.srv.Serve(s.lst); err != nil {
 			log.Fatalf("failed to serve: %v", err)
@@ -99,51 +155,364 @@ func (s *Server) Sync(stream apiV1.MqttSync_SyncServer) error {
 		ctx = stream.Context()
 	)
 
-	s.stream = stream
+	if s.cfg.UseTLS && verifiedCert(ctx) == nil {
+		s.log.Warn().Str("address", peerAddr(ctx)).Msg("peer without client certificate rejected")
+		return status.Error(codes.Unauthenticated, "client certificate is required")
+	}
+
+	req, err := stream.Recv()
+	if err != nil {
+		if status.Code(err) != codes.Canceled && err != io.EOF {
+			s.log.Error().Err(err).Msg("stream broken")
+		}
+		return err
+	}
+
+	p := newPeer(s.lastID.Add(1), stream, req.Handshake, s.cfg, s.log)
+	seq, err := s.addPeer(p)
+	if err != nil {
+		s.log.Error().Err(err).Str("peer", p.name).Msg("failed to create peer queue")
+		return status.Error(codes.Internal, "failed to create peer queue")
+	}
+	defer s.removePeer(p)
+
+	go p.run(ctx, s.queue)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.log.Info().
+		Str("peer", p.name).
+		Str("address", p.addr).
+		Str("prefix", p.prefix).
+		Strs("topics", p.topics).
+		Interface("metadata", md).
+		Msg("peer connected")
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.receive(ctx, p, seq)
+	}()
+
+	select {
+	case <-s.ctx.Done():
+		return nil
+	case <-p.disconnected:
+		s.log.Info().Str("peer", p.name).Str("address", p.addr).Msg("peer disconnected by the administrator")
+		return status.Error(codes.Aborted, "disconnected by the administrator")
+	case err := <-errCh:
+		return err
+	}
+}
 
+// receive handles messages and acknowledgements of the peer until the stream is closed
+func (s *Server) receive(ctx context.Context, p *peer, seq *sequence) error {
 	for {
 		select {
-		case <-s.ctx.Done():
-			return nil
 		case <-ctx.Done():
-			s.log.Debug().Str("reason", ctx.Err().Error()).Msg("stream closed")
+			s.log.Debug().Str("peer", p.name).Str("reason", ctx.Err().Error()).Msg("stream closed")
 			return ctx.Err()
 		default:
-			req, err := stream.Recv()
+			req, err := p.stream.Recv()
 			if err != nil {
 				if status.Code(err) != codes.Canceled && err != io.EOF {
-					s.log.Error().Err(err).Msg("stream broken")
+					s.log.Error().Err(err).Str("peer", p.name).Msg("stream broken")
 				}
 				return err
 			}
 
+			if req.Ack != nil {
+				p.outbox.ack(req.Ack.Seq)
+				continue
+			}
+
 			if s.uc == nil || len(req.Topic) == 0 {
-				s.queue.Pop(s)
-				md, _ := metadata.FromIncomingContext(ctx)
-				s.log.Debug().Interface("peer", md).Msg("peer connected")
 				continue
 			}
 
-			s.uc.OnMessage(req.Topic, req.Payload)
+			if seq.duplicate(req) {
+				s.log.Debug().Str("peer", p.name).Uint64("seq", req.Seq).Msg("duplicate message skipped")
+			} else {
+				if err := handleMessage(s.uc, "grpc.Server.receive", p.name, p.prefix, req); err != nil {
+					s.log.Error().Err(err).Str("peer", p.name).Uint64("seq", req.Seq).Msg("failed to handle message, resetting stream")
+					return status.Error(codes.Unavailable, err.Error())
+				}
+				seq.commit(req)
+				p.stats.countReceived(req)
+				observeReceived(req)
+			}
+
+			if ack := newAck(req); ack != nil {
+				if err := p.send(ack); err != nil {
+					s.log.Error().Err(err).Str("peer", p.name).Msg("failed to send acknowledgement")
+					return err
+				}
+			}
 		}
 	}
 }
 
-func (s *Server) Send(m entity.SyncMessage) (err error) {
-	err = s.send(m)
-	if err != nil {
-		s.queue.Push(m)
+// Serving reports whether the server accepts peers
+func (s *Server) Serving() bool {
+	return s.serving.Load()
+}
+
+// SetServing sets the status of the sync service reported by the health service
+func (s *Server) SetServing(serving bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
 	}
-	return
+	s.health.SetServingStatus("", status)
+	s.health.SetServingStatus(syncServiceName, status)
 }
 
+// Send sends the message to all connected peers interested in its topic,
+// the message is queued for known peers which are not connected
+// and in the shared queue while no peer is connected and no peer identity is known
+func (s *Server) Send(m entity.SyncMessage) (err error) {
+	m, span := startSend("grpc.Server.Send", m)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.send(m)
+}
+
+// send must be called with the read lock held
 func (s *Server) send(m entity.SyncMessage) error {
-	if s.stream == nil {
+	if len(s.peers) == 0 && len(s.queues) == 0 {
+		s.queue.Push(m)
 		return entity.ErrStreamDisabled
 	}
 
-	return s.stream.SendMsg(&apiV1.Message{
-		Topic:   m.Topic(),
-		Payload: m.Payload(),
+	var errs []error
+	for _, p := range s.peers {
+		if err := p.Send(m); err != nil {
+			errs = append(errs, fmt.Errorf("peer %s: %w", p.name, err))
+		}
+	}
+
+	for name, q := range s.queues {
+		if s.online[name] == 0 && strings.HasPrefix(m.Topic(), s.outboxes[name].prefix) {
+			q.Push(m)
+		}
+	}
+
+	if len(s.peers) == 0 {
+		errs = append(errs, entity.ErrStreamDisabled)
+	}
+
+	return errors.Join(errs...)
+}
+
+// addPeer registers the peer, unacknowledged messages, messages queued while the peer is not connected
+// and the received sequence are kept per peer identity across reconnections.
+// Peers without identity use the shared queue and keep their state only while connected.
+func (s *Server) addPeer(p *peer) (*sequence, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if p.anonymous {
+		p.queue = s.queue
+		p.outbox = newOutbox(p.name, p.prefix, s.log)
+		s.peers[p.id] = p
+		metrics.SetGRPCPeers(len(s.peers))
+		return &sequence{}, nil
+	}
+
+	q, ok := s.queues[p.name]
+	if !ok {
+		var err error
+		if q, err = newQueue(s.cfg.Queue, peerQueueName(p.name), s.log); err != nil {
+			return nil, err
+		}
+		s.queues[p.name] = q
+	}
+	p.queue = q
+
+	s.peers[p.id] = p
+	s.online[p.name]++
+	metrics.SetGRPCPeers(len(s.peers))
+
+	o, ok := s.outboxes[p.name]
+	if !ok {
+		o = newOutbox(p.name, p.prefix, s.log)
+		s.outboxes[p.name] = o
+	} else {
+		metrics.GRPCReconnect()
+	}
+	p.outbox = o
+
+	seq, ok := s.sequences[p.name]
+	if !ok {
+		seq = &sequence{}
+		s.sequences[p.name] = seq
+	}
+
+	return seq, nil
+}
+
+// removePeer unregisters the peer, unacknowledged messages of the peer without identity
+// are moved to the shared queue
+func (s *Server) removePeer(p *peer) {
+	s.Lock()
+	delete(s.peers, p.id)
+	if p.anonymous {
+		p.outbox.flush(s.queue)
+	} else if s.online[p.name]--; s.online[p.name] == 0 {
+		delete(s.online, p.name)
+	}
+	metrics.SetGRPCPeers(len(s.peers))
+	s.Unlock()
+	s.log.Info().Str("peer", p.name).Str("address", p.addr).Msg("peer disconnected")
+}
+
+// peerQueueName returns the name of the queue of the peer identity, the name is used as the queue directory.
+// Bytes other than ASCII letters, digits, '-' and '.' are escaped as _xx, so distinct identities never share a queue.
+func peerQueueName(name string) string {
+	var b strings.Builder
+	b.WriteString("peer-")
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '-' || c == '.' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// pendingQueues returns the shared queue and the queues of known peers
+func (s *Server) pendingQueues() map[string]queue {
+	s.RLock()
+	defer s.RUnlock()
+
+	queues := make(map[string]queue, len(s.queues)+1)
+	queues["server"] = s.queue
+	for name, q := range s.queues {
+		queues[peerQueueName(name)] = q
+	}
+
+	return queues
+}
+
+// peerInfos returns connected peers ordered by id
+func (s *Server) peerInfos() []*apiV1.PeerInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	peers := make([]*apiV1.PeerInfo, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p.info())
+	}
+	slices.SortFunc(peers, func(a, b *apiV1.PeerInfo) int {
+		return cmp.Compare(a.Id, b.Id)
 	})
+
+	return peers
+}
+
+// disconnectPeers closes streams of the peer with the id or all peers with the name if the id is zero
+func (s *Server) disconnectPeers(id uint64, name string) int {
+	s.RLock()
+	defer s.RUnlock()
+
+	var n int
+	for _, p := range s.peers {
+		if (id != 0 && p.id == id) || (id == 0 && len(name) != 0 && p.name == name) {
+			p.disconnect()
+			n++
+		}
+	}
+
+	return n
+}
+
+// flushQueue sends messages of the shared queue to the connected peers
+// or messages of the peer queue to the connected peer
+func (s *Server) flushQueue(name string) (int, error) {
+	if name == "server" {
+		return s.flushShared()
+	}
+
+	s.RLock()
+	var (
+		q queue
+		p *peer
+	)
+	for n, pq := range s.queues {
+		if peerQueueName(n) == name {
+			q = pq
+		}
+	}
+	for _, pp := range s.peers {
+		if peerQueueName(pp.name) == name {
+			p = pp
+			break
+		}
+	}
+	s.RUnlock()
+
+	switch {
+	case q == nil:
+		return 0, fmt.Errorf("queue %q not found", name)
+	case p == nil:
+		return 0, entity.ErrStreamDisabled
+	}
+
+	var n int
+	err := q.Pop(sendFunc(func(m entity.SyncMessage) error {
+		if err := p.replay(m); err != nil {
+			return err
+		}
+		n++
+		return nil
+	}))
+
+	return n, err
+}
+
+// flushShared sends messages of the shared queue to the connected peers
+func (s *Server) flushShared() (int, error) {
+	var n int
+	err := s.queue.Pop(sendFunc(func(m entity.SyncMessage) error {
+		s.RLock()
+		defer s.RUnlock()
+
+		if len(s.peers) == 0 {
+			return entity.ErrStreamDisabled
+		}
+		if err := s.send(m); err != nil {
+			return err
+		}
+		n++
+
+		return nil
+	}))
+
+	return n, err
+}
+
+// flush moves unacknowledged messages of all peers to their queues
+func (s *Server) flush() {
+	s.Lock()
+	defer s.Unlock()
+
+	for name, o := range s.outboxes {
+		o.flush(s.queues[name])
+	}
+}
+
+// closeQueues closes the shared queue and the queues of known peers
+func (s *Server) closeQueues() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.queue.Close()
+	for _, q := range s.queues {
+		q.Close()
+	}
 }
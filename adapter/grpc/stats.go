@@ -0,0 +1,58 @@
+package grpc
+
+import (
+	"sync/atomic"
+	"time"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+)
+
+// peerStats counters of the connection to the peer
+type peerStats struct {
+	connectedAt   time.Time
+	sent          atomic.Uint64
+	received      atomic.Uint64
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+}
+
+func newPeerStats() *peerStats {
+	return &peerStats{connectedAt: time.Now()}
+}
+
+// countSent counts the message sent to the peer, acknowledgements and handshakes are not counted
+func (s *peerStats) countSent(m *apiV1.Message) {
+	if len(m.Topic) == 0 {
+		return
+	}
+	s.sent.Add(1)
+	s.bytesSent.Add(uint64(len(m.Payload)))
+}
+
+// countReceived counts the message received from the peer
+func (s *peerStats) countReceived(m *apiV1.Message) {
+	s.received.Add(1)
+	s.bytesReceived.Add(uint64(len(m.Payload)))
+}
+
+// counting returns the send function counting sent messages
+func (s *peerStats) counting(send func(m *apiV1.Message) error) func(m *apiV1.Message) error {
+	return func(m *apiV1.Message) error {
+		if err := send(m); err != nil {
+			return err
+		}
+		s.countSent(m)
+		return nil
+	}
+}
+
+// info returns the peer info with the counters
+func (s *peerStats) info() *apiV1.PeerInfo {
+	return &apiV1.PeerInfo{
+		ConnectedAt:      s.connectedAt.UnixNano(),
+		MessagesSent:     s.sent.Load(),
+		MessagesReceived: s.received.Load(),
+		BytesSent:        s.bytesSent.Load(),
+		BytesReceived:    s.bytesReceived.Load(),
+	}
+}
@@ -0,0 +1,645 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+)
+
+type testMessage struct {
+	peer       string
+	topic      string
+	payload    []byte
+	qos        byte
+	retained   bool
+	duplicate  bool
+	messageID  uint16
+	properties *entity.MessageProperties
+	ctx        context.Context
+}
+
+func (m *testMessage) Topic() string {
+	return m.topic
+}
+
+func (m *testMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m *testMessage) QoS() byte {
+	return m.qos
+}
+
+func (m *testMessage) Retained() bool {
+	return m.retained
+}
+
+func (m *testMessage) Duplicate() bool {
+	return m.duplicate
+}
+
+func (m *testMessage) MessageID() uint16 {
+	return m.messageID
+}
+
+func (m *testMessage) Properties() *entity.MessageProperties {
+	return m.properties
+}
+
+var errTestPublish = errors.New("publish failed")
+
+// testUseCase receives messages, the first failures messages are rejected
+type testUseCase struct {
+	messages chan *testMessage
+	failures atomic.Int32
+}
+
+func (uc *testUseCase) OnMessage(peer string, m entity.SyncMessage) error {
+	if uc.failures.Add(-1) >= 0 {
+		return errTestPublish
+	}
+
+	uc.messages <- &testMessage{
+		peer:       peer,
+		topic:      m.Topic(),
+		payload:    m.Payload(),
+		qos:        m.QoS(),
+		retained:   m.Retained(),
+		duplicate:  m.Duplicate(),
+		messageID:  m.MessageID(),
+		properties: m.Properties(),
+		ctx:        entity.MessageContext(m),
+	}
+
+	return nil
+}
+
+var testPayloads = []struct {
+	name    string
+	payload []byte
+}{
+	{name: "json object", payload: []byte(`{"state":"ON","brightness":254}`)},
+	{name: "string", payload: []byte("OFF")},
+	{name: "number", payload: []byte("-12.75")},
+	{name: "array", payload: []byte(`["a",1,null]`)},
+	{name: "empty", payload: []byte{}},
+	{name: "binary", payload: []byte{0x00, 0xff, 0x7f, 0x80, 0x00, 0x01}},
+}
+
+func TestSyncOpaquePayload(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, cliUC := newTestClient(t, ctx, log, srv, &Config{})
+
+	for _, tt := range testPayloads {
+		t.Run("client to server "+tt.name, func(t *testing.T) {
+			if err := cli.Send(&testMessage{topic: "home/" + tt.name, payload: tt.payload}); err != nil {
+				t.Fatal(err)
+			}
+			expectMessage(t, srvUC.messages, "home/"+tt.name, tt.payload)
+		})
+	}
+
+	for _, tt := range testPayloads {
+		t.Run("server to client "+tt.name, func(t *testing.T) {
+			if err := srv.Send(&testMessage{topic: "vps/" + tt.name, payload: tt.payload}); err != nil {
+				t.Fatal(err)
+			}
+			expectMessage(t, cliUC.messages, "vps/"+tt.name, tt.payload)
+		})
+	}
+}
+
+func expectMessage(t *testing.T, messages <-chan *testMessage, topic string, payload []byte) *testMessage {
+	t.Helper()
+
+	select {
+	case m := <-messages:
+		if m.topic != topic {
+			t.Fatalf("unexpected topic %q, want %q", m.topic, topic)
+		}
+		if !bytes.Equal(m.payload, payload) {
+			t.Fatalf("payload changed: got %v, want %v", m.payload, payload)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %s not received", topic)
+	}
+	return nil
+}
+
+func TestSyncMessageFlags(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, cliUC := newTestClient(t, ctx, log, srv, &Config{})
+
+	sent := &testMessage{topic: "zigbee2mqtt/lamp", payload: []byte("ON"), qos: 1, retained: true, duplicate: true, messageID: 42}
+	if err := cli.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	expectFlags(t, expectMessage(t, srvUC.messages, sent.topic, sent.payload), sent)
+
+	sent = &testMessage{topic: "zigbee2mqtt/lamp/set", payload: []byte("OFF"), qos: 2, messageID: 65535}
+	if err := srv.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+	expectFlags(t, expectMessage(t, cliUC.messages, sent.topic, sent.payload), sent)
+}
+
+func TestSyncMessageProperties(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, _ := newTestClient(t, ctx, log, srv, &Config{})
+
+	expiry := uint32(60)
+	sent := &testMessage{
+		topic:   "rpc/request",
+		payload: []byte(`{"method":"ping"}`),
+		properties: &entity.MessageProperties{
+			ContentType:     "application/json",
+			ResponseTopic:   "rpc/response/1",
+			CorrelationData: []byte{0x01, 0x02},
+			MessageExpiry:   &expiry,
+			UserProperties: []entity.UserProperty{
+				{Key: "source", Value: "home"},
+				{Key: "source", Value: "bridge"},
+			},
+		},
+	}
+	if err := cli.Send(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	got := expectMessage(t, srvUC.messages, sent.topic, sent.payload)
+	if !reflect.DeepEqual(got.properties, sent.properties) {
+		t.Fatalf("properties changed: got %+v, want %+v", got.properties, sent.properties)
+	}
+}
+
+func TestSyncMultipleClients(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	_, homeA := newTestClient(t, ctx, log, srv, &Config{Topics: []string{"home-a/#"}})
+	_, homeB := newTestClient(t, ctx, log, srv, &Config{Topics: []string{"home-b/#", "common/+"}})
+
+	waitPeers(t, srv, 2)
+
+	messages := []*testMessage{
+		{topic: "home-a/light", payload: []byte("ON")},
+		{topic: "home-b/light", payload: []byte("OFF")},
+		{topic: "common/alarm", payload: []byte("1")},
+	}
+	for _, m := range messages {
+		if err := srv.Send(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectMessage(t, homeA.messages, "home-a/light", []byte("ON"))
+	expectMessage(t, homeB.messages, "home-b/light", []byte("OFF"))
+	expectMessage(t, homeB.messages, "common/alarm", []byte("1"))
+
+	select {
+	case m := <-homeA.messages:
+		t.Fatalf("unexpected message %s", m.topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSyncPeerNamespace(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1", TopicPrefix: "{peer}/"})
+	cliA, homeA := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-a"})
+	_, homeB := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-b"})
+
+	waitPeers(t, srv, 2)
+
+	if err := srv.Send(&testMessage{topic: "home-a/zigbee2mqtt/lamp/set", payload: []byte(`{"state":"ON"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Send(&testMessage{topic: "home-b/zigbee2mqtt/lamp/set", payload: []byte(`{"state":"OFF"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, homeA.messages, "zigbee2mqtt/lamp/set", []byte(`{"state":"ON"}`))
+	expectMessage(t, homeB.messages, "zigbee2mqtt/lamp/set", []byte(`{"state":"OFF"}`))
+
+	if err := cliA.Send(&testMessage{topic: "zigbee2mqtt/lamp", payload: []byte(`{"state":"ON"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	m := expectMessage(t, srvUC.messages, "home-a/zigbee2mqtt/lamp", []byte(`{"state":"ON"}`))
+	if m.peer != "home-a" {
+		t.Fatalf("unexpected peer %q", m.peer)
+	}
+}
+
+func TestSyncOfflinePeer(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	_, homeA := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-a"})
+	_, homeB := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-b"})
+
+	waitPeers(t, srv, 2)
+
+	if n := srv.disconnectPeers(0, "home-b"); n != 1 {
+		t.Fatalf("expected 1 disconnected peer, got %d", n)
+	}
+	waitPeers(t, srv, 1)
+
+	if err := srv.Send(&testMessage{topic: "vps/lamp", payload: []byte("ON")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, homeA.messages, "vps/lamp", []byte("ON"))
+	expectMessage(t, homeB.messages, "vps/lamp", []byte("ON"))
+
+	select {
+	case m := <-homeA.messages:
+		t.Fatalf("duplicate message %s", m.topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSyncAnonymousPeer(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	// the identity is taken from the client certificate only, the peer without it is anonymous
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1", PeerIDSource: peerIDSourceCert})
+	_, cliUC := newTestClient(t, ctx, log, srv, &Config{})
+
+	for i := 0; i < 2; i++ {
+		waitPeers(t, srv, 1)
+		if n := srv.disconnectPeers(srv.peerInfos()[0].Id, ""); n != 1 {
+			t.Fatalf("expected 1 disconnected peer, got %d", n)
+		}
+		waitPeers(t, srv, 0)
+
+		if err := srv.Send(&testMessage{topic: "vps/lamp", payload: []byte{byte('0' + i)}}); !errors.Is(err, entity.ErrStreamDisabled) {
+			t.Fatalf("expected %v, got %v", entity.ErrStreamDisabled, err)
+		}
+		expectMessage(t, cliUC.messages, "vps/lamp", []byte{byte('0' + i)})
+	}
+
+	srv.RLock()
+	state := len(srv.queues) + len(srv.outboxes) + len(srv.sequences) + len(srv.online)
+	srv.RUnlock()
+	if state != 0 {
+		t.Fatalf("state of the peer without identity is kept: %d entries", state)
+	}
+}
+
+func TestSyncSharedQueue(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1", TopicPrefix: "{peer}/"})
+
+	for _, m := range []*testMessage{
+		{topic: "home-a/lamp/set", payload: []byte("ON")},
+		{topic: "home-b/lamp/set", payload: []byte("OFF")},
+	} {
+		if err := srv.Send(m); !errors.Is(err, entity.ErrStreamDisabled) {
+			t.Fatalf("expected %v, got %v", entity.ErrStreamDisabled, err)
+		}
+	}
+
+	_, homeA := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-a"})
+	expectMessage(t, homeA.messages, "lamp/set", []byte("ON"))
+
+	_, homeB := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-b"})
+	expectMessage(t, homeB.messages, "lamp/set", []byte("OFF"))
+
+	if n := srv.queue.Len(); n != 0 {
+		t.Fatalf("expected empty shared queue, got %d", n)
+	}
+}
+
+func TestPeerQueueName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "home-a", want: "peer-home-a"},
+		{name: "a/b", want: "peer-a_2fb"},
+		{name: "a_b", want: "peer-a_5fb"},
+		{name: "10.0.0.1:5000", want: "peer-10.0.0.1_3a5000"},
+		{name: "../etc", want: "peer-.._2fetc"},
+	}
+
+	names := make(map[string]string, len(tests))
+	for _, tt := range tests {
+		got := peerQueueName(tt.name)
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.name, got, tt.want)
+		}
+		if other, ok := names[got]; ok {
+			t.Errorf("%q and %q share the queue %q", tt.name, other, got)
+		}
+		names[got] = tt.name
+	}
+}
+
+func TestPeerQueueFull(t *testing.T) {
+	log := logger.New(logger.Config{Level: "disabled"})
+	p := &peer{
+		name:     "home-a",
+		messages: make(chan entity.SyncMessage, 1),
+		queue:    newMemoryQueue(&queuePolicy{defaultMode: QueueModeAll}, log),
+		log:      log,
+	}
+
+	for _, payload := range []string{"1", "2"} {
+		if err := p.Send(&testMessage{topic: "home/lamp", payload: []byte(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(p.messages) != 1 || p.queue.Len() != 1 {
+		t.Fatalf("expected 1 queued and 1 saved message, got %d and %d", len(p.messages), p.queue.Len())
+	}
+}
+
+func TestSyncAcknowledgement(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, cliUC := newTestClient(t, ctx, log, srv, &Config{PeerID: "home-a"})
+
+	waitPeers(t, srv, 1)
+
+	if err := cli.Send(&testMessage{topic: "home/lamp", payload: []byte("ON")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Send(&testMessage{topic: "vps/lamp", payload: []byte("OFF")}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, srvUC.messages, "home/lamp", []byte("ON"))
+	expectMessage(t, cliUC.messages, "vps/lamp", []byte("OFF"))
+
+	waitAcked(t, cli.outbox)
+	srv.RLock()
+	o := srv.outboxes["home-a"]
+	srv.RUnlock()
+	waitAcked(t, o)
+}
+
+func TestSyncRedelivery(t *testing.T) {
+	for _, peerID := range []string{"home-a", ""} {
+		t.Run("peer id "+peerID, func(t *testing.T) {
+			testSyncRedelivery(t, peerID)
+		})
+	}
+}
+
+func testSyncRedelivery(t *testing.T, peerID string) {
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, cliUC := newTestClient(t, ctx, log, srv, &Config{PeerID: peerID})
+
+	waitPeers(t, srv, 1)
+
+	t.Run("client to server", func(t *testing.T) {
+		srvUC.failures.Store(1)
+		if err := cli.Send(&testMessage{topic: "home/lamp", payload: []byte("ON")}); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, srvUC.messages, "home/lamp", []byte("ON"))
+		waitAcked(t, cli.outbox)
+	})
+
+	waitPeers(t, srv, 1)
+
+	t.Run("server to client", func(t *testing.T) {
+		cliUC.failures.Store(1)
+		if err := srv.Send(&testMessage{topic: "vps/lamp", payload: []byte("OFF")}); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, cliUC.messages, "vps/lamp", []byte("OFF"))
+	})
+
+	select {
+	case m := <-srvUC.messages:
+		t.Fatalf("duplicate message %s", m.topic)
+	case m := <-cliUC.messages:
+		t.Fatalf("duplicate message %s", m.topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientPeerID(t *testing.T) {
+	cfg := &Config{Queue: &QueueConfig{Persistent: true, Dir: t.TempDir()}}
+
+	first, err := clientPeerID(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := clientPeerID(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) == 0 || first != second {
+		t.Fatalf("generated peer id is not kept: %q, %q", first, second)
+	}
+
+	if id, _ := clientPeerID(&Config{PeerID: "home-a", Queue: cfg.Queue}); id != "home-a" {
+		t.Fatalf("configured peer id is not used: %q", id)
+	}
+}
+
+func TestSequenceDuplicate(t *testing.T) {
+	seq := &sequence{}
+
+	first := &apiV1.Message{Seq: 1, Epoch: 1}
+	second := &apiV1.Message{Seq: 2, Epoch: 1}
+	if seq.duplicate(first) {
+		t.Fatal("first message is not a duplicate")
+	}
+	seq.commit(first)
+	seq.commit(second)
+
+	if !seq.duplicate(first) || !seq.duplicate(second) {
+		t.Fatal("retransmitted messages are duplicates")
+	}
+	if seq.duplicate(&apiV1.Message{Seq: 3, Epoch: 1}) {
+		t.Fatal("next message is not a duplicate")
+	}
+	if seq.duplicate(&apiV1.Message{Seq: 1, Epoch: 2}) {
+		t.Fatal("message of the new epoch is not a duplicate")
+	}
+	if seq.duplicate(&apiV1.Message{}) {
+		t.Fatal("message without sequence is never a duplicate")
+	}
+}
+
+func waitAcked(t *testing.T, o *outbox) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if len(o.unacked()) == 0 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("messages are not acknowledged: %d", len(o.unacked()))
+}
+
+func newTestContext(t *testing.T) (context.Context, *logger.Logger) {
+	ctx, cancel := context.WithCancel(entity.CreateWg(context.Background()))
+	t.Cleanup(func() {
+		cancel()
+		entity.GetWg(ctx).Wait()
+	})
+	return ctx, logger.New(logger.Config{Level: "disabled"})
+}
+
+func newTestServer(t *testing.T, ctx context.Context, log *logger.Logger, cfg *Config) (*Server, *testUseCase) {
+	srv, err := NewServer(ctx, cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := &testUseCase{messages: make(chan *testMessage, len(testPayloads))}
+	srv.SetSyncUseCase(uc)
+	srv.Start()
+	return srv, uc
+}
+
+func newTestClient(t *testing.T, ctx context.Context, log *logger.Logger, srv *Server, cfg *Config) (*Client, *testUseCase) {
+	cfg.Host = "127.0.0.1"
+	cfg.Port = srv.lst.Addr().(*net.TCPAddr).Port
+	cfg.ConnectRetryInterval = time.Second
+
+	cli, err := NewClient(ctx, cfg, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := &testUseCase{messages: make(chan *testMessage, len(testPayloads))}
+	cli.SetSyncUseCase(uc)
+	if err := cli.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cli, uc
+}
+
+func waitPeers(t *testing.T, srv *Server, n int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		srv.RLock()
+		count := len(srv.peers)
+		srv.RUnlock()
+		if count == n {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected %d peers", n)
+}
+
+func expectFlags(t *testing.T, got, want *testMessage) {
+	t.Helper()
+
+	if got.qos != want.qos || got.retained != want.retained || got.duplicate != want.duplicate || got.messageID != want.messageID {
+		t.Fatalf("flags changed: got qos=%d retained=%v duplicate=%v id=%d, want qos=%d retained=%v duplicate=%v id=%d",
+			got.qos, got.retained, got.duplicate, got.messageID, want.qos, want.retained, want.duplicate, want.messageID)
+	}
+}
+
+func TestHealthService(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srv, _ := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1", Reflection: true})
+
+	conn, err := grpc.NewClient(srv.lst.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	check := func(expected healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		for _, service := range []string{"", syncServiceName} {
+			resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != expected {
+				t.Fatalf("service %q: expected %s, got %s", service, expected, resp.Status)
+			}
+		}
+	}
+
+	check(healthpb.HealthCheckResponse_NOT_SERVING)
+	srv.SetServing(true)
+	check(healthpb.HealthCheckResponse_SERVING)
+	srv.SetServing(false)
+	check(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	if _, ok := srv.srv.GetServiceInfo()["grpc.reflection.v1.ServerReflection"]; !ok {
+		t.Fatal("reflection service is not registered")
+	}
+}
+
+func TestSyncTracing(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+	})
+
+	ctx, log := newTestContext(t)
+
+	srv, srvUC := newTestServer(t, ctx, log, &Config{Host: "127.0.0.1"})
+	cli, _ := newTestClient(t, ctx, log, srv, &Config{})
+
+	spanCtx, span := otel.Tracer("test").Start(context.Background(), "mqtt.receive")
+	if err := cli.Send(entity.WithContext(&testMessage{topic: "home/lamp", payload: []byte("ON")}, spanCtx)); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	m := expectMessage(t, srvUC.messages, "home/lamp", []byte("ON"))
+	if trace.SpanContextFromContext(m.ctx).TraceID() != span.SpanContext().TraceID() {
+		t.Fatal("trace is not propagated to the server")
+	}
+
+	traceID := span.SpanContext().TraceID()
+	for i := 0; i < 100; i++ {
+		names := make(map[string]bool)
+		for _, s := range exp.GetSpans() {
+			if s.SpanContext.TraceID() == traceID {
+				names[s.Name] = true
+			}
+		}
+		if names["grpc.Client.Send"] && names["grpc.Server.receive"] {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("spans are not recorded: %v", exp.GetSpans())
+}
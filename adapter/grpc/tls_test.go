@@ -0,0 +1,74 @@
+package grpc
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/forest33/mqtt-sync/pkg/cert"
+)
+
+// writeTestCerts writes the CA, the server and the client certificates and returns TLS settings of the server and the client
+func writeTestCerts(t *testing.T, clientCN string) (*Config, *Config) {
+	t.Helper()
+
+	dir := t.TempDir()
+	req := func(cn string, hosts ...string) *cert.Request {
+		return &cert.Request{CommonName: cn, Hosts: hosts, Validity: time.Hour}
+	}
+
+	ca, err := cert.NewCA(req("test CA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := ca.IssueServer(req("127.0.0.1", "127.0.0.1", "localhost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := ca.IssueClient(req(clientCN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	for name, p := range map[string]*cert.Pair{"ca": ca, "server": srv, "client": cli} {
+		if err := p.Write(file(name+"-cert.pem"), file(name+"-key.pem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Config{UseTLS: true, CACert: file("ca-cert.pem"), Cert: file("server-cert.pem"), Key: file("server-key.pem")},
+		&Config{UseTLS: true, CACert: file("ca-cert.pem"), Cert: file("client-cert.pem"), Key: file("client-key.pem")}
+}
+
+func TestLoadGeneratedCerts(t *testing.T) {
+	srvCfg, cliCfg := writeTestCerts(t, "home-a")
+
+	for _, cfg := range []*Config{srvCfg, cliCfg} {
+		if _, err := loadTLSCredentials(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyncTLS(t *testing.T) {
+	ctx, log := newTestContext(t)
+
+	srvCfg, cliCfg := writeTestCerts(t, "home-a")
+	srvCfg.Host = "127.0.0.1"
+
+	srv, _ := newTestServer(t, ctx, log, srvCfg)
+	_, uc := newTestClient(t, ctx, log, srv, cliCfg)
+	waitPeers(t, srv, 1)
+
+	if peers := srv.peerInfos(); peers[0].Name != "home-a" {
+		t.Fatalf("peer is not identified by the certificate: %s", peers[0].Name)
+	}
+
+	if err := srv.Send(&testMessage{topic: "home/light", payload: []byte("ON")}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, uc.messages, "home/light", []byte("ON"))
+}
@@ -0,0 +1,39 @@
+package grpc
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+// startSend starts the span of sending the message, the returned message carries the span
+func startSend(name string, m entity.SyncMessage) (entity.SyncMessage, trace.Span) {
+	ctx, span := tracing.Tracer().Start(entity.MessageContext(m), name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", m.Topic())),
+	)
+	return entity.WithContext(m, ctx), span
+}
+
+// handleMessage passes the message received from the peer to the use case within the span continuing the trace of the peer
+func handleMessage(uc entity.SyncUseCase, name, peer, prefix string, req *apiV1.Message) error {
+	m := newMessage(req, prefix)
+
+	var span trace.Span
+	m.ctx, span = tracing.Tracer().Start(m.ctx, name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", m.topic),
+			attribute.String("peer", peer),
+			attribute.Int64("seq", int64(req.Seq)),
+		),
+	)
+
+	err := uc.OnMessage(peer, m)
+	tracing.End(span, err)
+
+	return err
+}
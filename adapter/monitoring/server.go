@@ -0,0 +1,117 @@
+// Package monitoring provides the HTTP server exposing metrics and health checks
+package monitoring
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/health"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+)
+
+const (
+	readHeaderTimeout = 10 * time.Second
+	shutdownTimeout   = 5 * time.Second
+)
+
+type Config struct {
+	Host string
+	Port int
+}
+
+type Server struct {
+	cfg    *Config
+	log    *logger.Logger
+	lst    net.Listener
+	srv    *http.Server
+	health *health.Status
+}
+
+// readiness is the response of the readiness endpoint
+type readiness struct {
+	Ready  bool            `json:"ready"`
+	Checks map[string]bool `json:"checks"`
+}
+
+func NewServer(ctx context.Context, cfg *Config, log *logger.Logger) (*Server, error) {
+	s := &Server{
+		cfg: cfg,
+		log: log,
+	}
+
+	var err error
+	s.lst, err = net.Listen("tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+
+	s.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+
+	entity.GetWg(ctx).Add(1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.srv.Shutdown(shutdownCtx); err != nil {
+			s.log.Error().Err(err).Msg("failed to stop monitoring server")
+		}
+		s.log.Info().Msg("monitoring server stopped")
+		entity.GetWg(ctx).Done()
+	}()
+
+	return s, nil
+}
+
+func (s *Server) Start() {
+	s.log.Info().
+		Str("host", s.cfg.Host).
+		Int("port", s.cfg.Port).
+		Msg("monitoring server started")
+	go func() {
+		if err := s.srv.Serve(s.lst); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.log.Fatalf("failed to serve: %v", err)
+		}
+	}()
+}
+
+// SetHealth sets the readiness checks, the server is ready when no checks are set
+func (s *Server) SetHealth(h *health.Status) {
+	s.health = h
+}
+
+// healthz reports that the process is alive
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte("ok"))
+}
+
+// readyz reports whether all components are ready
+func (s *Server) readyz(w http.ResponseWriter, _ *http.Request) {
+	resp := readiness{Ready: true}
+	if s.health != nil {
+		resp.Ready, resp.Checks = s.health.Ready()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.log.Error().Err(err).Msg("failed to write readiness response")
+	}
+}
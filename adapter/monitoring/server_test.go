@@ -0,0 +1,60 @@
+package monitoring
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/forest33/mqtt-sync/pkg/health"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+)
+
+func TestReadyz(t *testing.T) {
+	var connected atomic.Bool
+
+	h := health.New()
+	h.Add("mqtt", connected.Load)
+
+	s := &Server{log: logger.NewDefault()}
+	s.SetHealth(h)
+
+	resp := readyz(t, s, http.StatusServiceUnavailable)
+	if resp.Ready || resp.Checks["mqtt"] {
+		t.Fatalf("unexpected readiness %+v", resp)
+	}
+
+	connected.Store(true)
+	resp = readyz(t, s, http.StatusOK)
+	if !resp.Ready || !resp.Checks["mqtt"] {
+		t.Fatalf("unexpected readiness %+v", resp)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	s := &Server{log: logger.NewDefault()}
+
+	rec := httptest.NewRecorder()
+	s.healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+}
+
+func readyz(t *testing.T, s *Server, code int) readiness {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	s.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != code {
+		t.Fatalf("expected status %d, got %d", code, rec.Code)
+	}
+
+	var resp readiness
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
@@ -3,33 +3,35 @@ package mqtt
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/forest33/mqtt-sync/business/entity"
-	"github.com/forest33/mqtt-sync/pkg/codec"
 	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
 )
 
 type Client struct {
 	cfg                       *Config
 	log                       *logger.Logger
 	cli                       mqtt.Client
-	codec                     codec.Codec
 	externalConnectHandler    ConnectHandler
 	externalDisconnectHandler DisconnectHandler
+	connects                  atomic.Uint64
+	connected                 atomic.Bool
 }
 
 type MessageHandler func(m entity.SyncMessage)
 type ConnectHandler func()
 type DisconnectHandler func()
 
-func New(ctx context.Context, cfg *Config, log *logger.Logger, codec codec.Codec) (*Client, error) {
+func New(ctx context.Context, cfg *Config, log *logger.Logger) (*Client, error) {
 	m := &Client{
-		cfg:   cfg,
-		log:   log,
-		codec: codec,
+		cfg: cfg,
+		log: log,
 	}
 
 	tlsConfig, err := cfg.getTLSConfig()
@@ -43,6 +45,7 @@ func New(ctx context.Context, cfg *Config, log *logger.Logger, codec codec.Codec
 	} else {
 		opts.AddBroker(fmt.Sprintf("ssl://%s:%d", cfg.Host, cfg.Port))
 	}
+	opts.SetProtocolVersion(uint(cfg.ProtocolVersion))
 	opts.SetClientID(fmt.Sprintf("%s-%d", cfg.ClientID, time.Now().Unix()))
 	opts.SetUsername(cfg.User)
 	opts.SetPassword(cfg.Password)
@@ -66,22 +69,31 @@ func New(ctx context.Context, cfg *Config, log *logger.Logger, codec codec.Codec
 	return m, nil
 }
 
-func (c *Client) Publish(topic string, payload []byte) error {
-	token := c.cli.Publish(topic, 0, false, payload)
-	if token.WaitTimeout(c.cfg.Timeout) && token.Error() != nil {
-		return token.Error()
+func (c *Client) Publish(m entity.SyncMessage) (err error) {
+	_, span := startPublish(m)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	token := c.cli.Publish(m.Topic(), m.QoS(), m.Retained(), m.Payload())
+	if !token.WaitTimeout(c.cfg.Timeout) {
+		metrics.PublishError()
+		return entity.ErrPublishTimeout
+	}
+
+	if err := token.Error(); err != nil {
+		metrics.PublishError()
+		return err
 	}
 
 	return nil
 }
 
-func (c *Client) Subscribe(topic string, handler MessageHandler) error {
-	token := c.cli.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		m, err := c.newMessage(msg)
-		if err != nil {
-			c.log.Error().Err(err).Str("topic", topic).Str("payload", string(msg.Payload())).Msg("failed to create message")
-			return
-		}
+func (c *Client) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	token := c.cli.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		m := newMessage(msg)
+		span := startReceive(m)
+		defer span.End()
 		handler(m)
 	})
 	if token.WaitTimeout(c.cfg.Timeout) && token.Error() != nil {
@@ -101,6 +113,11 @@ func (c *Client) Close() {
 	c.cli.Disconnect(1000)
 }
 
+// Connected reports whether the client is connected to the broker
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
 func (c *Client) SetConnectHandler(h ConnectHandler) {
 	c.externalConnectHandler = h
 }
@@ -115,6 +132,11 @@ func (c *Client) messagePubHandler(_ mqtt.Client, msg mqtt.Message) {
 
 func (c *Client) connectHandler(_ mqtt.Client) {
 	c.log.Info().Str("host", c.cfg.Host).Int("port", c.cfg.Port).Msg("MQTT connected")
+	c.connected.Store(true)
+	metrics.SetMQTTConnected(true)
+	if c.connects.Add(1) > 1 {
+		metrics.MQTTReconnect()
+	}
 	if c.externalConnectHandler != nil {
 		c.externalConnectHandler()
 	}
@@ -122,4 +144,9 @@ func (c *Client) connectHandler(_ mqtt.Client) {
 
 func (c *Client) connectLostHandler(_ mqtt.Client, err error) {
 	c.log.Error().Msgf("MQTT connect lost: %v", err)
+	c.connected.Store(false)
+	metrics.SetMQTTConnected(false)
+	if c.externalDisconnectHandler != nil {
+		c.externalDisconnectHandler()
+	}
 }
@@ -0,0 +1,246 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/topic"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+const (
+	ProtocolVersionV5 = 5
+
+	keepAliveV5 = 30
+)
+
+// ClientV5 is an MQTT 5 client
+type ClientV5 struct {
+	ctx                       context.Context
+	cfg                       *Config
+	log                       *logger.Logger
+	cliCfg                    autopaho.ClientConfig
+	cm                        *autopaho.ConnectionManager
+	handlers                  map[string]MessageHandler
+	externalConnectHandler    ConnectHandler
+	externalDisconnectHandler DisconnectHandler
+	connects                  atomic.Uint64
+	connected                 atomic.Bool
+	sync.RWMutex
+}
+
+func NewV5(ctx context.Context, cfg *Config, log *logger.Logger) (*ClientV5, error) {
+	c := &ClientV5{
+		ctx:      ctx,
+		cfg:      cfg,
+		log:      log,
+		handlers: make(map[string]MessageHandler),
+	}
+
+	tlsConfig, err := cfg.getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "mqtt"
+	if cfg.ServerTLS {
+		scheme = "tls"
+	}
+	serverURL, err := url.Parse(fmt.Sprintf("%s://%s:%d", scheme, cfg.Host, cfg.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	c.cliCfg = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		TlsCfg:                        tlsConfig,
+		KeepAlive:                     keepAliveV5,
+		CleanStartOnInitialConnection: true,
+		ReconnectBackoff:              autopaho.NewConstantBackoff(cfg.ConnectRetryInterval),
+		ConnectTimeout:                cfg.Timeout,
+		ConnectUsername:               cfg.User,
+		ConnectPassword:               []byte(cfg.Password),
+		OnConnectionUp:                c.connectHandler,
+		OnConnectError:                c.connectErrorHandler,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           fmt.Sprintf("%s-%d", cfg.ClientID, time.Now().Unix()),
+			OnPublishReceived:  []func(paho.PublishReceived) (bool, error){c.publishHandler},
+			OnServerDisconnect: c.serverDisconnectHandler,
+			OnClientError:      c.connectLostHandler,
+		},
+	}
+
+	entity.GetWg(ctx).Add(1)
+	go func() {
+		<-ctx.Done()
+		c.Close()
+		log.Info().Msg("MQTT client disconnected")
+		entity.GetWg(ctx).Done()
+	}()
+
+	return c, nil
+}
+
+func (c *ClientV5) Publish(m entity.SyncMessage) (err error) {
+	spanCtx, span := startPublish(m)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	cm := c.connection()
+	if cm == nil {
+		metrics.PublishError()
+		return autopaho.ConnectionDownError
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.Timeout)
+	defer cancel()
+
+	_, err = cm.Publish(ctx, &paho.Publish{
+		QoS:        m.QoS(),
+		Retain:     m.Retained(),
+		Topic:      m.Topic(),
+		Payload:    m.Payload(),
+		Properties: newPublishProperties(spanCtx, m.Properties()),
+	})
+	if err != nil {
+		metrics.PublishError()
+	}
+
+	return err
+}
+
+func (c *ClientV5) Subscribe(topic string, qos byte, handler MessageHandler) error {
+	c.Lock()
+	c.handlers[topic] = handler
+	c.Unlock()
+
+	cm := c.connection()
+	if cm == nil {
+		return autopaho.ConnectionDownError
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.Timeout)
+	defer cancel()
+
+	// the retain flag of forwarded messages is kept, the broker clears it for live messages otherwise
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos, RetainAsPublished: true}},
+	})
+
+	return err
+}
+
+func (c *ClientV5) Connect() error {
+	c.Lock()
+	cm, err := autopaho.NewConnection(c.ctx, c.cliCfg)
+	c.cm = cm
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.cfg.Timeout)
+	defer cancel()
+
+	if err := cm.AwaitConnection(ctx); err != nil {
+		c.log.Error().Err(err).Msg("MQTT connection is not established yet, retrying in background")
+	}
+
+	return nil
+}
+
+func (c *ClientV5) Close() {
+	cm := c.connection()
+	if cm == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := cm.Disconnect(ctx); err != nil {
+		c.log.Error().Err(err).Msg("failed to disconnect MQTT client")
+	}
+}
+
+func (c *ClientV5) connection() *autopaho.ConnectionManager {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cm
+}
+
+// Connected reports whether the client is connected to the broker
+func (c *ClientV5) Connected() bool {
+	return c.connected.Load()
+}
+
+func (c *ClientV5) SetConnectHandler(h ConnectHandler) {
+	c.externalConnectHandler = h
+}
+
+func (c *ClientV5) SetDisconnectHandler(h DisconnectHandler) {
+	c.externalDisconnectHandler = h
+}
+
+func (c *ClientV5) publishHandler(pr paho.PublishReceived) (bool, error) {
+	m := newMessageV5(pr.Packet)
+	span := startReceive(m)
+	defer span.End()
+
+	c.RLock()
+	defer c.RUnlock()
+
+	var handled bool
+	for filter, h := range c.handlers {
+		if topic.Match(filter, m.Topic()) {
+			h(m)
+			handled = true
+		}
+	}
+
+	if !handled {
+		c.log.Debug().Msgf("MQTT received message: %s from topic: %s\n", m.Payload(), m.Topic())
+	}
+
+	return handled, nil
+}
+
+func (c *ClientV5) connectHandler(_ *autopaho.ConnectionManager, _ *paho.Connack) {
+	c.log.Info().Str("host", c.cfg.Host).Int("port", c.cfg.Port).Int("version", ProtocolVersionV5).Msg("MQTT connected")
+	c.connected.Store(true)
+	metrics.SetMQTTConnected(true)
+	if c.connects.Add(1) > 1 {
+		metrics.MQTTReconnect()
+	}
+	if c.externalConnectHandler != nil {
+		c.externalConnectHandler()
+	}
+}
+
+func (c *ClientV5) connectErrorHandler(err error) {
+	c.log.Error().Msgf("MQTT connect error: %v", err)
+}
+
+func (c *ClientV5) serverDisconnectHandler(d *paho.Disconnect) {
+	c.connectLostHandler(fmt.Errorf("server requested disconnect, reason code %d", d.ReasonCode))
+}
+
+func (c *ClientV5) connectLostHandler(err error) {
+	c.log.Error().Msgf("MQTT connect lost: %v", err)
+	c.connected.Store(false)
+	metrics.SetMQTTConnected(false)
+	if c.externalDisconnectHandler != nil {
+		c.externalDisconnectHandler()
+	}
+}
@@ -0,0 +1,34 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+)
+
+func TestClientV5NotConnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(entity.CreateWg(context.Background()))
+	t.Cleanup(func() {
+		cancel()
+		entity.GetWg(ctx).Wait()
+	})
+
+	c, err := NewV5(ctx, &Config{Host: "127.0.0.1", Port: 1883, Timeout: time.Second}, logger.New(logger.Config{Level: "disabled"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newMessage(&testMessage{topic: "home/lamp", payload: []byte("ON")})
+	if err := c.Publish(msg); !errors.Is(err, autopaho.ConnectionDownError) {
+		t.Fatalf("expected %v, got %v", autopaho.ConnectionDownError, err)
+	}
+	if err := c.Subscribe("home/#", 0, func(entity.SyncMessage) {}); !errors.Is(err, autopaho.ConnectionDownError) {
+		t.Fatalf("expected %v, got %v", autopaho.ConnectionDownError, err)
+	}
+}
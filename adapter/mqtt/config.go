@@ -12,6 +12,7 @@ type Config struct {
 	Host                 string
 	Port                 int
 	ClientID             string
+	ProtocolVersion      int
 	User                 string
 	Password             string
 	UseTLS               bool
@@ -22,7 +23,6 @@ type Config struct {
 	InsecureSkipVerify   bool
 	ConnectRetryInterval time.Duration
 	Timeout              time.Duration
-	PayloadKey           string
 }
 
 func (cfg Config) getTLSConfig() (*tls.Config, error) {
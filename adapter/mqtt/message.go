@@ -1,17 +1,27 @@
 package mqtt
 
 import (
+	"context"
+	"slices"
+
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
-	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
 )
 
+// message is an MQTT message, payload is opaque and forwarded as is.
+// Properties are available only for MQTT 5 messages.
 type message struct {
 	topic      string
 	payload    []byte
-	codec      codec.Codec
-	data       map[string]interface{}
-	payloadKey bool
+	qos        byte
+	retained   bool
+	duplicate  bool
+	messageID  uint16
+	properties *entity.MessageProperties
+	ctx        context.Context
 }
 
 func (m *message) Topic() string {
@@ -22,36 +32,112 @@ func (m *message) Payload() []byte {
 	return m.payload
 }
 
-func (m *message) IsPayloadKey() bool {
-	return m.payloadKey
+func (m *message) QoS() byte {
+	return m.qos
+}
+
+func (m *message) Retained() bool {
+	return m.retained
+}
+
+func (m *message) Duplicate() bool {
+	return m.duplicate
 }
 
-func (c *Client) newMessage(msg mqtt.Message) (*message, error) {
-	var (
-		data map[string]interface{}
-		err  error
-	)
+func (m *message) MessageID() uint16 {
+	return m.messageID
+}
 
-	payload := msg.Payload()
+func (m *message) Properties() *entity.MessageProperties {
+	return m.properties
+}
 
-	if err := c.codec.Unmarshal(payload, &data); err != nil {
-		return nil, err
+func (m *message) Context() context.Context {
+	return m.ctx
+}
+
+func newMessage(msg mqtt.Message) *message {
+	return &message{
+		topic:     msg.Topic(),
+		payload:   msg.Payload(),
+		qos:       msg.Qos(),
+		retained:  msg.Retained(),
+		duplicate: msg.Duplicate(),
+		messageID: msg.MessageID(),
+		ctx:       context.Background(),
 	}
+}
 
-	_, payloadKey := data[c.cfg.PayloadKey]
-	if !payloadKey {
-		data[c.cfg.PayloadKey] = 1
-		payload, err = c.codec.Marshal(data)
-		if err != nil {
-			return nil, err
+func newMessageV5(p *paho.Publish) *message {
+	m := &message{
+		topic:     p.Topic,
+		payload:   p.Payload,
+		qos:       p.QoS,
+		retained:  p.Retain,
+		duplicate: p.Duplicate(),
+		messageID: p.PacketID,
+		ctx:       context.Background(),
+	}
+
+	if p.Properties != nil {
+		m.properties = &entity.MessageProperties{
+			ContentType:     p.Properties.ContentType,
+			ResponseTopic:   p.Properties.ResponseTopic,
+			CorrelationData: p.Properties.CorrelationData,
+			MessageExpiry:   p.Properties.MessageExpiry,
+			UserProperties:  make([]entity.UserProperty, 0, len(p.Properties.User)),
+		}
+		for _, up := range p.Properties.User {
+			m.properties.UserProperties = append(m.properties.UserProperties, entity.UserProperty{Key: up.Key, Value: up.Value})
 		}
+		m.ctx = tracing.Extract(m.ctx, traceCarrier(p.Properties.User))
 	}
 
-	return &message{
-		topic:      msg.Topic(),
-		payload:    payload,
-		codec:      c.codec,
-		data:       data,
-		payloadKey: payloadKey,
-	}, nil
+	return m
+}
+
+// newPublishProperties converts the message properties, the trace context of ctx replaces the one of the properties
+func newPublishProperties(ctx context.Context, p *entity.MessageProperties) *paho.PublishProperties {
+	carrier := tracing.Inject(ctx)
+	if p == nil {
+		if carrier == nil {
+			return nil
+		}
+		p = &entity.MessageProperties{}
+	}
+
+	props := &paho.PublishProperties{
+		ContentType:     p.ContentType,
+		ResponseTopic:   p.ResponseTopic,
+		CorrelationData: p.CorrelationData,
+		MessageExpiry:   p.MessageExpiry,
+		User:            make(paho.UserProperties, 0, len(p.UserProperties)),
+	}
+	for _, up := range p.UserProperties {
+		if carrier != nil && slices.Contains(tracing.Fields(), up.Key) {
+			continue
+		}
+		props.User = append(props.User, paho.UserProperty{Key: up.Key, Value: up.Value})
+	}
+	for _, k := range tracing.Fields() {
+		if v, ok := carrier[k]; ok {
+			props.User = append(props.User, paho.UserProperty{Key: k, Value: v})
+		}
+	}
+
+	return props
+}
+
+// traceCarrier returns the trace context of the user properties
+func traceCarrier(user paho.UserProperties) map[string]string {
+	var carrier map[string]string
+	for _, k := range tracing.Fields() {
+		if v := user.Get(k); len(v) != 0 {
+			if carrier == nil {
+				carrier = make(map[string]string, len(tracing.Fields()))
+			}
+			carrier[k] = v
+		}
+	}
+	return carrier
 }
@@ -0,0 +1,133 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+)
+
+type testMessage struct {
+	topic     string
+	payload   []byte
+	qos       byte
+	retained  bool
+	duplicate bool
+	messageID uint16
+}
+
+func (m *testMessage) Duplicate() bool   { return m.duplicate }
+func (m *testMessage) Qos() byte         { return m.qos }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return m.messageID }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func TestNewMessageOpaquePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "json object", payload: []byte(`{"state":"ON","brightness":254}`)},
+		{name: "string", payload: []byte("ON")},
+		{name: "number", payload: []byte("23.5")},
+		{name: "array", payload: []byte(`[1,2,3]`)},
+		{name: "empty", payload: []byte{}},
+		{name: "binary", payload: []byte{0x00, 0xff, 0x10, 0x80, 0xfe, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMessage(&testMessage{topic: "zigbee2mqtt/device", payload: tt.payload})
+			if m.Topic() != "zigbee2mqtt/device" {
+				t.Fatalf("unexpected topic %q", m.Topic())
+			}
+			if !bytes.Equal(m.Payload(), tt.payload) {
+				t.Fatalf("payload changed: got %v, want %v", m.Payload(), tt.payload)
+			}
+		})
+	}
+}
+
+func TestNewMessageFlags(t *testing.T) {
+	m := newMessage(&testMessage{topic: "zigbee2mqtt/device", qos: 2, retained: true, duplicate: true, messageID: 7})
+	if m.QoS() != 2 || !m.Retained() || !m.Duplicate() || m.MessageID() != 7 {
+		t.Fatalf("unexpected flags: qos=%d retained=%v duplicate=%v id=%d", m.QoS(), m.Retained(), m.Duplicate(), m.MessageID())
+	}
+}
+
+func TestNewMessageV5Flags(t *testing.T) {
+	m := newMessageV5(paho.PublishFromPacketPublish(&packets.Publish{Topic: "zigbee2mqtt/device", QoS: 2, Retain: true, Duplicate: true, PacketID: 7, Properties: &packets.Properties{}}))
+	if m.QoS() != 2 || !m.Retained() || !m.Duplicate() || m.MessageID() != 7 {
+		t.Fatalf("unexpected flags: qos=%d retained=%v duplicate=%v id=%d", m.QoS(), m.Retained(), m.Duplicate(), m.MessageID())
+	}
+}
+
+func TestNewMessageV5Properties(t *testing.T) {
+	expiry := uint32(30)
+	m := newMessageV5(&paho.Publish{
+		Topic:   "rpc/request",
+		Payload: []byte("ping"),
+		QoS:     1,
+		Properties: &paho.PublishProperties{
+			ContentType:     "text/plain",
+			ResponseTopic:   "rpc/response",
+			CorrelationData: []byte("42"),
+			MessageExpiry:   &expiry,
+			User:            paho.UserProperties{{Key: "trace", Value: "abc"}},
+		},
+	})
+
+	props := m.Properties()
+	if props == nil {
+		t.Fatal("properties are lost")
+	}
+	if props.ContentType != "text/plain" || props.ResponseTopic != "rpc/response" || string(props.CorrelationData) != "42" {
+		t.Fatalf("unexpected properties %+v", props)
+	}
+	if props.MessageExpiry == nil || *props.MessageExpiry != expiry {
+		t.Fatal("message expiry is lost")
+	}
+	if len(props.UserProperties) != 1 || props.UserProperties[0].Key != "trace" || props.UserProperties[0].Value != "abc" {
+		t.Fatalf("unexpected user properties %+v", props.UserProperties)
+	}
+
+	back := newPublishProperties(context.Background(), props)
+	if back.ContentType != "text/plain" || len(back.User) != 1 || back.User.Get("trace") != "abc" {
+		t.Fatalf("unexpected publish properties %+v", back)
+	}
+}
+
+func TestTraceContextUserProperties(t *testing.T) {
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(tracetest.NewInMemoryExporter()))
+	ctx, span := tp.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	props := newPublishProperties(ctx, &entity.MessageProperties{
+		UserProperties: []entity.UserProperty{
+			{Key: "traceparent", Value: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			{Key: "source", Value: "home"},
+		},
+	})
+	if len(props.User.GetAll("traceparent")) != 1 || props.User.Get("source") != "home" {
+		t.Fatalf("unexpected user properties %+v", props.User)
+	}
+
+	m := newMessageV5(&paho.Publish{Topic: "zigbee2mqtt/lamp/set", Properties: props})
+	got := trace.SpanContextFromContext(m.Context())
+	if got.TraceID() != span.SpanContext().TraceID() || got.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("trace context is not extracted: %v", got)
+	}
+
+	if props := newPublishProperties(context.Background(), nil); props != nil {
+		t.Fatalf("unexpected properties without trace %+v", props)
+	}
+}
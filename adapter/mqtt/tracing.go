@@ -0,0 +1,29 @@
+package mqtt
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+// startReceive starts the span of the message received from the broker, the message carries the span
+func startReceive(m *message) trace.Span {
+	var span trace.Span
+	m.ctx, span = tracing.Tracer().Start(m.ctx, "mqtt.receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", m.topic)),
+	)
+	return span
+}
+
+// startPublish starts the span of publishing the message to the broker
+func startPublish(m entity.SyncMessage) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(entity.MessageContext(m), "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", m.Topic())),
+	)
+}
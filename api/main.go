@@ -1,3 +1,4 @@
 package mqtt_sync_service
 
 //go:generate protoc ./v1/mqtt-sync.v1.proto --go_out=plugins=grpc:v1/.
+//go:generate protoc ./v1/mqtt-sync-admin.v1.proto --go_out=plugins=grpc:v1/.
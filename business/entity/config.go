@@ -2,27 +2,47 @@
 package entity
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/forest33/mqtt-sync/pkg/config"
+	"github.com/forest33/mqtt-sync/pkg/topic"
 )
 
 type Config struct {
-	Server  *Server  `yaml:"Server"`
-	Client  *Client  `yaml:"Client"`
-	MQTT    *MQTT    `yaml:"MQTT"`
-	Sync    *Sync    `yaml:"Sync"`
-	Logger  *Logger  `yaml:"Logger"`
-	Runtime *Runtime `yaml:"Runtime"`
+	Server     *Server     `yaml:"Server"`
+	Client     *Client     `yaml:"Client"`
+	MQTT       *MQTT       `yaml:"MQTT"`
+	Sync       *Sync       `yaml:"Sync"`
+	Queue      *Queue      `yaml:"Queue"`
+	Monitoring *Monitoring `yaml:"Monitoring"`
+	Tracing    *Tracing    `yaml:"Tracing"`
+	Admin      *Admin      `yaml:"Admin"`
+	Logger     *Logger     `yaml:"Logger"`
+	Runtime    *Runtime    `yaml:"Runtime"`
 }
 
 type Server struct {
-	Enabled   bool       `yaml:"Enabled" default:"false"`
-	Host      string     `yaml:"Host" default:""`
-	Port      int        `yaml:"Port" default:"31883"`
-	UseTLS    bool       `yaml:"UseTLS"  default:"false"`
-	CACert    string     `yaml:"CACert"  default:""`
-	Cert      string     `yaml:"Cert"  default:""`
-	Key       string     `yaml:"Key" default:""`
-	Keepalive *Keepalive `yaml:"Keepalive"`
+	Enabled      bool        `yaml:"Enabled" default:"false"`
+	Host         string      `yaml:"Host" default:""`
+	Port         int         `yaml:"Port" default:"31883"`
+	UseTLS       bool        `yaml:"UseTLS"  default:"false"`
+	CACert       string      `yaml:"CACert"  default:""`
+	Cert         string      `yaml:"Cert"  default:""`
+	Key          string      `yaml:"Key" default:""`
+	PeerIDSource string      `yaml:"PeerIDSource" default:"auto"`
+	TopicPrefix  string      `yaml:"TopicPrefix" default:""`
+	Reflection   bool        `yaml:"Reflection" default:"false"`
+	Keepalive    *Keepalive  `yaml:"Keepalive"`
+	Enrollment   *Enrollment `yaml:"Enrollment"`
+}
+
+// Enrollment issuing of client certificates in exchange for one-time tokens, CAKey is the key of Server.CACert,
+// Validity of issued certificates in days
+type Enrollment struct {
+	Enabled  bool   `yaml:"Enabled" default:"false"`
+	CAKey    string `yaml:"CAKey" default:""`
+	Validity int    `yaml:"Validity" default:"365"`
 }
 
 type Client struct {
@@ -35,9 +55,37 @@ type Client struct {
 	Key                  string     `yaml:"Key" default:""`
 	InsecureSkipVerify   bool       `yaml:"InsecureSkipVerify"  default:"true"`
 	ConnectRetryInterval int        `yaml:"ConnectRetryInterval" default:"3"`
+	PeerID               string     `yaml:"PeerID" default:""`
 	Keepalive            *Keepalive `yaml:"Keepalive"`
 }
 
+// Monitoring HTTP server exposing metrics, TopicLevels is the number of topic levels used as the metrics label
+type Monitoring struct {
+	Enabled     bool   `yaml:"Enabled" default:"false"`
+	Host        string `yaml:"Host" default:""`
+	Port        int    `yaml:"Port" default:"9883"`
+	TopicLevels int    `yaml:"TopicLevels" default:"1"`
+}
+
+// Tracing OTLP trace exporter, SampleRatio is the fraction of sampled traces started by this instance
+type Tracing struct {
+	Enabled     bool    `yaml:"Enabled" default:"false"`
+	Endpoint    string  `yaml:"Endpoint" default:"127.0.0.1:4317"`
+	UseTLS      bool    `yaml:"UseTLS" default:"false"`
+	ServiceName string  `yaml:"ServiceName" default:"mqtt-sync"`
+	SampleRatio float64 `yaml:"SampleRatio" default:"1"`
+}
+
+// Admin gRPC admin API on a separate listener, requests must carry the Token as a bearer token
+type Admin struct {
+	Enabled bool   `yaml:"Enabled" default:"false"`
+	Host    string `yaml:"Host" default:"127.0.0.1"`
+	Port    int    `yaml:"Port" default:"31884"`
+	Token   string `yaml:"Token" default:""`
+	Cert    string `yaml:"Cert" default:""`
+	Key     string `yaml:"Key" default:""`
+}
+
 type Keepalive struct {
 	PingMinTime         int  `yaml:"KeepalivePingMinTime" default:"30"`
 	Time                int  `yaml:"KeepaliveTime" default:"30"`
@@ -49,6 +97,7 @@ type MQTT struct {
 	Host                 string `yaml:"Host" default:"127.0.0.1"`
 	Port                 int    `yaml:"Port" default:"1883"`
 	ClientID             string `yaml:"ClientID" default:"mqtt-sync"`
+	ProtocolVersion      int    `yaml:"ProtocolVersion" default:"4"`
 	User                 string `yaml:"User" default:""`
 	Password             string `yaml:"Password" default:""`
 	UseTLS               bool   `yaml:"UseTLS"  default:"false"`
@@ -61,8 +110,85 @@ type MQTT struct {
 }
 
 type Sync struct {
-	Topics     []string `yaml:"Topics"`
-	PayloadKey string   `yaml:"PayloadKey" default:"___mqtt_sync___"`
+	Topics        []string         `yaml:"Topics"`
+	Inbound       *TopicRules      `yaml:"Inbound"`
+	Outbound      *TopicRules      `yaml:"Outbound"`
+	Rewrite       []*RewriteRule   `yaml:"Rewrite"`
+	Transform     []*TransformRule `yaml:"Transform"`
+	Scripts       []*ScriptRule    `yaml:"Scripts"`
+	RateLimits    []*RateLimitRule `yaml:"RateLimits"`
+	Dedup         []*DedupRule     `yaml:"Dedup"`
+	SubscribeQoS  map[string]int   `yaml:"SubscribeQoS" default:""`
+	PublishQoS    string           `yaml:"PublishQoS" default:"keep"`
+	PublishRetain string           `yaml:"PublishRetain" default:"keep"`
+	EchoTTL       int              `yaml:"EchoTTL" default:"30"`
+	QueueMode     string           `yaml:"QueueMode" default:""`
+	QueuePolicies []*QueuePolicy   `yaml:"QueuePolicies"`
+}
+
+// TopicRules topic filters of the direction, empty Include allows all topics
+type TopicRules struct {
+	Include []string `yaml:"Include"`
+	Exclude []string `yaml:"Exclude"`
+}
+
+type RewriteRule struct {
+	Local     string `yaml:"Local"`
+	Remote    string `yaml:"Remote"`
+	Regex     string `yaml:"Regex"`
+	Replace   string `yaml:"Replace"`
+	Direction string `yaml:"Direction"`
+}
+
+// TransformRule JSON payload transformation of messages matching the topic filter
+type TransformRule struct {
+	Topic     string                 `yaml:"Topic"`
+	Direction string                 `yaml:"Direction"`
+	Include   []string               `yaml:"Include"`
+	Exclude   []string               `yaml:"Exclude"`
+	Rename    map[string]string      `yaml:"Rename"`
+	Set       map[string]interface{} `yaml:"Set"`
+}
+
+// ScriptRule Lua script handling messages matching the topic filter, Timeout in milliseconds
+type ScriptRule struct {
+	Topic     string `yaml:"Topic"`
+	Direction string `yaml:"Direction"`
+	File      string `yaml:"File"`
+	Timeout   int    `yaml:"Timeout"`
+}
+
+// RateLimitRule limits outbound messages of every topic matching the filter,
+// Rate in messages per second, Interval in seconds
+type RateLimitRule struct {
+	Topic    string  `yaml:"Topic"`
+	Mode     string  `yaml:"Mode"`
+	Rate     float64 `yaml:"Rate"`
+	Burst    int     `yaml:"Burst"`
+	Interval int     `yaml:"Interval"`
+}
+
+// DedupRule skips messages of every topic matching the filter when the payload has not changed,
+// Ignore lists JSON object keys which are not compared
+type DedupRule struct {
+	Topic     string   `yaml:"Topic"`
+	Direction string   `yaml:"Direction"`
+	Ignore    []string `yaml:"Ignore"`
+}
+
+type QueuePolicy struct {
+	Topic string `yaml:"Topic"`
+	Mode  string `yaml:"Mode"`
+	Limit int    `yaml:"Limit"`
+}
+
+type Queue struct {
+	Persistent  bool   `yaml:"Persistent" default:"false"`
+	Dir         string `yaml:"Dir" default:"/data/queue"`
+	SegmentSize int64  `yaml:"SegmentSize" default:"8388608"`
+	MaxSize     int64  `yaml:"MaxSize" default:"268435456"`
+	MaxAge      int    `yaml:"MaxAge" default:"604800"`
+	DropPolicy  string `yaml:"DropPolicy" default:"oldest"`
 }
 
 type Logger struct {
@@ -93,3 +219,80 @@ func GetConfig() (ConfigHandler, *Config, error) {
 	}
 	return h, cfg, nil
 }
+
+// LoadConfig reads the config file, the path set by the environment variable is used if the path is empty
+func LoadConfig(path string) (ConfigHandler, *Config, error) {
+	if len(path) == 0 {
+		return GetConfig()
+	}
+
+	cfg := &Config{}
+	h, err := config.Load(path, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, cfg, nil
+}
+
+// Validate checks settings which do not depend on each other's components, all problems are returned
+func (c *Config) Validate() error {
+	var errs []error
+
+	if !c.Server.Enabled && !c.Client.Enabled {
+		errs = append(errs, errors.New("neither Server nor Client is enabled"))
+	}
+	if c.Server.Enabled {
+		errs = append(errs, checkPort("Server.Port", c.Server.Port))
+		errs = append(errs, checkTLS("Server", c.Server.UseTLS, c.Server.CACert, c.Server.Cert, c.Server.Key))
+		if c.Server.Enrollment.Enabled && (!c.Server.UseTLS || len(c.Server.Enrollment.CAKey) == 0) {
+			errs = append(errs, errors.New("Server.Enrollment: UseTLS and CAKey are required"))
+		}
+	}
+	if c.Client.Enabled {
+		errs = append(errs, checkPort("Client.Port", c.Client.Port))
+		errs = append(errs, checkTLS("Client", c.Client.UseTLS, c.Client.CACert, c.Client.Cert, c.Client.Key))
+	}
+
+	errs = append(errs, checkPort("MQTT.Port", c.MQTT.Port))
+	if c.MQTT.ProtocolVersion < 3 || c.MQTT.ProtocolVersion > 5 {
+		errs = append(errs, fmt.Errorf("MQTT.ProtocolVersion: unsupported version %d", c.MQTT.ProtocolVersion))
+	}
+
+	if len(c.Sync.Topics) == 0 {
+		errs = append(errs, errors.New("Sync.Topics: no topics"))
+	}
+	for _, t := range c.Sync.Topics {
+		if err := topic.Validate(t); err != nil {
+			errs = append(errs, fmt.Errorf("Sync.Topics: %w", err))
+		}
+	}
+
+	if c.Monitoring.Enabled {
+		errs = append(errs, checkPort("Monitoring.Port", c.Monitoring.Port))
+	}
+	if c.Tracing.Enabled && (c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1) {
+		errs = append(errs, fmt.Errorf("Tracing.SampleRatio: %v is out of range [0, 1]", c.Tracing.SampleRatio))
+	}
+	if c.Admin.Enabled {
+		errs = append(errs, checkPort("Admin.Port", c.Admin.Port))
+		if len(c.Admin.Token) == 0 {
+			errs = append(errs, errors.New("Admin.Token: token is not set"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func checkPort(name string, port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("%s: invalid port %d", name, port)
+	}
+	return nil
+}
+
+func checkTLS(name string, useTLS bool, ca, cert, key string) error {
+	if useTLS && (len(ca) == 0 || len(cert) == 0 || len(key) == 0) {
+		return fmt.Errorf("%s: CACert, Cert and Key are required with UseTLS", name)
+	}
+	return nil
+}
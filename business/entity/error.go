@@ -4,4 +4,5 @@ import "errors"
 
 var (
 	ErrStreamDisabled = errors.New("stream is disabled")
+	ErrPublishTimeout = errors.New("publish timeout")
 )
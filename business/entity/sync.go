@@ -1,11 +1,67 @@
 package entity
 
+import (
+	"context"
+)
+
+const (
+	PublishQoSKeep      = "keep"
+	PublishRetainKeep   = "keep"
+	PublishRetainAlways = "always"
+	PublishRetainNever  = "never"
+
+	DirectionOutbound = "outbound"
+	DirectionInbound  = "inbound"
+)
+
 type SyncMessage interface {
 	Topic() string
 	Payload() []byte
-	IsPayloadKey() bool
+	QoS() byte
+	Retained() bool
+	Duplicate() bool
+	MessageID() uint16
+	Properties() *MessageProperties
+}
+
+// MessageProperties MQTT 5 publish properties
+type MessageProperties struct {
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	MessageExpiry   *uint32
+	UserProperties  []UserProperty
+}
+
+// UserProperty MQTT 5 user property
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// contextMessage is a message with the context carrying its trace
+type contextMessage struct {
+	SyncMessage
+	ctx context.Context
+}
+
+func (m *contextMessage) Context() context.Context {
+	return m.ctx
+}
+
+// WithContext returns the message with the context
+func WithContext(m SyncMessage, ctx context.Context) SyncMessage {
+	return &contextMessage{SyncMessage: m, ctx: ctx}
+}
+
+// MessageContext returns the context of the message, the background context if the message has none
+func MessageContext(m SyncMessage) context.Context {
+	if c, ok := m.(interface{ Context() context.Context }); ok && c.Context() != nil {
+		return c.Context()
+	}
+	return context.Background()
 }
 
 type SyncUseCase interface {
-	OnMessage(topic string, payload []byte)
+	OnMessage(peer string, m SyncMessage) error
 }
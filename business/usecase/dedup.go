@@ -0,0 +1,43 @@
+package usecase
+
+import (
+	"fmt"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/pkg/dedup"
+)
+
+// dedupFilters unchanged payload filters of both directions
+type dedupFilters struct {
+	outbound *dedup.Filter
+	inbound  *dedup.Filter
+}
+
+func newDedupFilters(rules []*entity.DedupRule, c codec.Codec) (*dedupFilters, error) {
+	var outbound, inbound []dedup.Rule
+	for _, r := range rules {
+		rule := dedup.Rule{Topic: r.Topic, Ignore: r.Ignore}
+		switch r.Direction {
+		case "", entity.DirectionOutbound:
+			outbound = append(outbound, rule)
+		case entity.DirectionInbound:
+			inbound = append(inbound, rule)
+		default:
+			return nil, fmt.Errorf("unknown dedup direction %q for topic %s", r.Direction, r.Topic)
+		}
+	}
+
+	var (
+		d   = &dedupFilters{}
+		err error
+	)
+	if d.outbound, err = dedup.New(outbound, c); err != nil {
+		return nil, err
+	}
+	if d.inbound, err = dedup.New(inbound, c); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
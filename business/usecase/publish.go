@@ -0,0 +1,86 @@
+package usecase
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+)
+
+const (
+	maxQoS = 2
+)
+
+// publishPolicy defines how messages received from the peer are republished to the broker.
+// MQTT 3.1.1 brokers clear the retain flag of live messages, only retained messages sent after subscribing
+// carry it, so the keep policy preserves the retained state only for them unless the peer uses MQTT 5
+type publishPolicy struct {
+	qos    int
+	retain string
+}
+
+type publishMessage struct {
+	entity.SyncMessage
+	qos      byte
+	retained bool
+}
+
+func (m *publishMessage) QoS() byte {
+	return m.qos
+}
+
+func (m *publishMessage) Retained() bool {
+	return m.retained
+}
+
+func newPublishPolicy(cfg *entity.Sync) (*publishPolicy, error) {
+	p := &publishPolicy{
+		qos:    -1,
+		retain: cfg.PublishRetain,
+	}
+
+	if cfg.PublishQoS != entity.PublishQoSKeep {
+		qos, err := strconv.Atoi(cfg.PublishQoS)
+		if err != nil || qos < 0 || qos > maxQoS {
+			return nil, fmt.Errorf("invalid publish QoS: %s", cfg.PublishQoS)
+		}
+		p.qos = qos
+	}
+
+	switch cfg.PublishRetain {
+	case entity.PublishRetainKeep, entity.PublishRetainAlways, entity.PublishRetainNever:
+	default:
+		return nil, fmt.Errorf("invalid publish retain policy: %s", cfg.PublishRetain)
+	}
+
+	for t, qos := range cfg.SubscribeQoS {
+		if qos < 0 || qos > maxQoS {
+			return nil, fmt.Errorf("invalid subscribe QoS %d for topic %s", qos, t)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *publishPolicy) apply(m entity.SyncMessage) entity.SyncMessage {
+	if p.qos < 0 && p.retain == entity.PublishRetainKeep {
+		return m
+	}
+
+	pm := &publishMessage{
+		SyncMessage: m,
+		qos:         m.QoS(),
+		retained:    m.Retained(),
+	}
+	if p.qos >= 0 {
+		pm.qos = byte(p.qos)
+	}
+	switch p.retain {
+	case entity.PublishRetainAlways:
+		pm.retained = true
+	case entity.PublishRetainNever:
+		pm.retained = false
+	}
+
+	return pm
+}
@@ -0,0 +1,64 @@
+package usecase
+
+import (
+	"time"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/ratelimit"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+)
+
+const (
+	rateLimitReportInterval = time.Minute
+)
+
+func newRateLimiter(rules []*entity.RateLimitRule, emit, drop func(m entity.SyncMessage)) (*ratelimit.Limiter[entity.SyncMessage], error) {
+	r := make([]ratelimit.Rule, 0, len(rules))
+	for _, rule := range rules {
+		r = append(r, ratelimit.Rule{
+			Topic:    rule.Topic,
+			Mode:     rule.Mode,
+			Rate:     rule.Rate,
+			Burst:    rule.Burst,
+			Interval: time.Duration(rule.Interval) * time.Second,
+		})
+	}
+	return ratelimit.New(r, emit, drop)
+}
+
+// suppressed counts the outbound message dropped by the rate limiter
+func (uc *SyncUseCase) suppressed(m entity.SyncMessage) {
+	uc.log.Debug().Str("topic", m.Topic()).Msg("outbound message rate limited")
+	metrics.Dropped(metrics.DropRateLimit)
+	uc.observe(entity.DirectionOutbound, "", m, tap.ReasonRateLimit)
+}
+
+// reportRateLimits periodically logs the number of suppressed messages until the context is done
+func (uc *SyncUseCase) reportRateLimits() {
+	ticker := time.NewTicker(rateLimitReportInterval)
+	defer ticker.Stop()
+
+	reported := make(map[string]uint64)
+	for {
+		select {
+		case <-uc.ctx.Done():
+			uc.limit.Close()
+			entity.GetWg(uc.ctx).Done()
+			return
+		case <-ticker.C:
+			for _, s := range uc.limit.Stats() {
+				if s.Suppressed == reported[s.Topic] {
+					continue
+				}
+				reported[s.Topic] = s.Suppressed
+				uc.log.Info().
+					Str("topic", s.Topic).
+					Str("mode", s.Mode).
+					Uint64("passed", s.Passed).
+					Uint64("suppressed", s.Suppressed).
+					Msg("rate limited messages")
+			}
+		}
+	}
+}
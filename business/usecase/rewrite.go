@@ -0,0 +1,38 @@
+package usecase
+
+import (
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/rewrite"
+)
+
+// rewrittenMessage is a message with the rewritten topic
+type rewrittenMessage struct {
+	entity.SyncMessage
+	topic string
+}
+
+func (m *rewrittenMessage) Topic() string {
+	return m.topic
+}
+
+func newRewriter(rules []*entity.RewriteRule) (*rewrite.Rewriter, error) {
+	r := make([]rewrite.Rule, 0, len(rules))
+	for _, rule := range rules {
+		r = append(r, rewrite.Rule{
+			Local:     rule.Local,
+			Remote:    rule.Remote,
+			Regex:     rule.Regex,
+			Replace:   rule.Replace,
+			Direction: rule.Direction,
+		})
+	}
+	return rewrite.New(r)
+}
+
+// withTopic returns the message with the topic, the message is returned as is if the topic is not changed
+func withTopic(m entity.SyncMessage, topic string) entity.SyncMessage {
+	if topic == m.Topic() {
+		return m
+	}
+	return &rewrittenMessage{SyncMessage: m, topic: topic}
+}
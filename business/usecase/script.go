@@ -0,0 +1,148 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/script"
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	defaultScriptTimeout = 100 * time.Millisecond
+)
+
+// scriptMessage is a message produced by the script, MQTT 5 properties are taken from the original message
+type scriptMessage struct {
+	entity.SyncMessage
+	m *script.Message
+}
+
+func (m *scriptMessage) Topic() string {
+	return m.m.Topic
+}
+
+func (m *scriptMessage) Payload() []byte {
+	return m.m.Payload
+}
+
+func (m *scriptMessage) QoS() byte {
+	return m.m.QoS
+}
+
+func (m *scriptMessage) Retained() bool {
+	return m.m.Retained
+}
+
+func (m *scriptMessage) Duplicate() bool {
+	return false
+}
+
+func (m *scriptMessage) MessageID() uint16 {
+	return 0
+}
+
+type scriptStage struct {
+	filter string
+	s      *script.Script
+}
+
+// scripts script stages of both directions
+type scripts struct {
+	log      *logger.Logger
+	outbound []*scriptStage
+	inbound  []*scriptStage
+}
+
+func newScripts(rules []*entity.ScriptRule, c codec.Codec, log *logger.Logger) (*scripts, error) {
+	s := &scripts{log: log}
+
+	for _, r := range rules {
+		if err := topic.Validate(r.Topic); err != nil {
+			return nil, err
+		}
+
+		timeout := time.Duration(r.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = defaultScriptTimeout
+		}
+
+		sc, err := script.Load(r.File, timeout, c)
+		if err != nil {
+			return nil, err
+		}
+
+		stage := &scriptStage{filter: r.Topic, s: sc}
+		switch r.Direction {
+		case "", entity.DirectionOutbound:
+			s.outbound = append(s.outbound, stage)
+		case entity.DirectionInbound:
+			s.inbound = append(s.inbound, stage)
+		default:
+			return nil, fmt.Errorf("unknown script direction %q for script %s", r.Direction, r.File)
+		}
+
+		log.Info().Str("script", r.File).Str("topic", r.Topic).Str("direction", r.Direction).Msg("script loaded")
+	}
+
+	return s, nil
+}
+
+// run passes the message through the scripts matching the topic in order and returns the messages to forward.
+// A failed script does not change the message.
+func (s *scripts) run(stages []*scriptStage, direction, peer string, m entity.SyncMessage) []entity.SyncMessage {
+	messages := []entity.SyncMessage{m}
+
+	for _, stage := range stages {
+		next := make([]entity.SyncMessage, 0, len(messages))
+		for _, msg := range messages {
+			if !topic.Match(stage.filter, msg.Topic()) {
+				next = append(next, msg)
+				continue
+			}
+
+			in := &script.Message{
+				Topic:    msg.Topic(),
+				Payload:  msg.Payload(),
+				QoS:      msg.QoS(),
+				Retained: msg.Retained(),
+			}
+			out, err := stage.s.Run(in, newScriptMeta(direction, peer, msg))
+			if err != nil {
+				s.log.Error().Err(err).Str("topic", msg.Topic()).Msg("script failed, message is forwarded unchanged")
+				next = append(next, msg)
+				continue
+			}
+
+			for _, o := range out {
+				if o == in {
+					next = append(next, msg)
+				} else {
+					next = append(next, &scriptMessage{SyncMessage: msg, m: o})
+				}
+			}
+		}
+		messages = next
+	}
+
+	return messages
+}
+
+func newScriptMeta(direction, peer string, m entity.SyncMessage) *script.Meta {
+	meta := &script.Meta{
+		Direction: direction,
+		Peer:      peer,
+	}
+
+	if props := m.Properties(); props != nil && len(props.UserProperties) != 0 {
+		meta.UserProperties = make(map[string]string, len(props.UserProperties))
+		for _, p := range props.UserProperties {
+			meta.UserProperties[p.Key] = p.Value
+		}
+	}
+
+	return meta
+}
@@ -2,19 +2,45 @@ package usecase
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/forest33/mqtt-sync/adapter/grpc"
 	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/pkg/echo"
 	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/ratelimit"
+	"github.com/forest33/mqtt-sync/pkg/rewrite"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+	"github.com/forest33/mqtt-sync/pkg/topic"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
 )
 
 type SyncUseCase struct {
-	ctx  context.Context
-	cfg  *entity.Config
-	log  *logger.Logger
-	mqtt MqttClient
-	srv  *grpc.Server
-	cli  *grpc.Client
+	ctx       context.Context
+	cfg       *entity.Config
+	log       *logger.Logger
+	mqtt      MqttClient
+	srv       *grpc.Server
+	cli       *grpc.Client
+	peers     Forwarder
+	echo      *echo.Filter
+	pub       *publishPolicy
+	inbound   *topic.Filter
+	outbound  *topic.Filter
+	rewrite   *rewrite.Rewriter
+	transform *transformers
+	scripts   *scripts
+	limit     *ratelimit.Limiter[entity.SyncMessage]
+	dedup     *dedupFilters
+	tap       *tap.Hub
 }
 
 func NewSyncUseCase(ctx context.Context, cfg *entity.Config, log *logger.Logger, mqtt MqttClient, srv *grpc.Server, cli *grpc.Client) (*SyncUseCase, error) {
@@ -25,8 +51,24 @@ func NewSyncUseCase(ctx context.Context, cfg *entity.Config, log *logger.Logger,
 		mqtt: mqtt,
 		srv:  srv,
 		cli:  cli,
+		echo: echo.New(time.Duration(cfg.Sync.EchoTTL) * time.Second),
+		tap:  tap.New(),
+	}
+
+	switch {
+	case srv != nil:
+		uc.peers = srv
+	case cli != nil:
+		uc.peers = cli
 	}
 
+	if err := uc.loadRules(); err != nil {
+		return nil, err
+	}
+
+	entity.GetWg(ctx).Add(1)
+	go uc.reportRateLimits()
+
 	if uc.srv != nil {
 		uc.srv.SetSyncUseCase(uc)
 		uc.srv.Start()
@@ -40,6 +82,7 @@ func NewSyncUseCase(ctx context.Context, cfg *entity.Config, log *logger.Logger,
 	}
 
 	uc.mqtt.SetConnectHandler(uc.OnConnect)
+	uc.mqtt.SetDisconnectHandler(uc.OnDisconnect)
 	if err := uc.mqtt.Connect(); err != nil {
 		return nil, err
 	}
@@ -47,37 +90,243 @@ func NewSyncUseCase(ctx context.Context, cfg *entity.Config, log *logger.Logger,
 	return uc, nil
 }
 
+// ValidateConfig checks the sync rules of the config without connecting to anything
+func ValidateConfig(cfg *entity.Config, log *logger.Logger) error {
+	uc := &SyncUseCase{cfg: cfg, log: log}
+	return uc.loadRules()
+}
+
+// loadRules compiles topic rules, transformations, scripts and limits of the config
+func (uc *SyncUseCase) loadRules() error {
+	var err error
+	uc.pub, err = newPublishPolicy(uc.cfg.Sync)
+	if err != nil {
+		return err
+	}
+
+	uc.inbound, err = topic.NewFilter(uc.cfg.Sync.Inbound.Include, uc.cfg.Sync.Inbound.Exclude)
+	if err != nil {
+		return fmt.Errorf("inbound topic rules: %w", err)
+	}
+	uc.outbound, err = topic.NewFilter(uc.cfg.Sync.Outbound.Include, uc.cfg.Sync.Outbound.Exclude)
+	if err != nil {
+		return fmt.Errorf("outbound topic rules: %w", err)
+	}
+
+	uc.rewrite, err = newRewriter(uc.cfg.Sync.Rewrite)
+	if err != nil {
+		return err
+	}
+
+	uc.transform, err = newTransformers(uc.cfg.Sync.Transform, codec.NewFastJsonCodec())
+	if err != nil {
+		return err
+	}
+
+	uc.scripts, err = newScripts(uc.cfg.Sync.Scripts, codec.NewFastJsonCodec(), uc.log)
+	if err != nil {
+		return err
+	}
+
+	uc.dedup, err = newDedupFilters(uc.cfg.Sync.Dedup, codec.NewFastJsonCodec())
+	if err != nil {
+		return err
+	}
+
+	uc.limit, err = newRateLimiter(uc.cfg.Sync.RateLimits, uc.forward, uc.suppressed)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (uc *SyncUseCase) OnConnect() {
 	for _, t := range uc.cfg.Sync.Topics {
-		if err := uc.mqtt.Subscribe(t, uc.mqttMessage); err != nil {
+		qos := byte(uc.cfg.Sync.SubscribeQoS[t])
+		if err := uc.mqtt.Subscribe(t, qos, uc.mqttMessage); err != nil {
 			uc.log.Fatalf("failed to subscribe to topic %s: %v", t, err)
 		}
-		uc.log.Info().Str("topic", t).Msg("subscribed to topic")
+		uc.log.Info().Str("topic", t).Uint8("qos", qos).Msg("subscribed to topic")
+	}
+
+	if uc.srv != nil {
+		uc.srv.SetServing(true)
 	}
 }
 
-func (uc *SyncUseCase) OnMessage(topic string, payload []byte) {
-	uc.log.Debug().Str("topic", topic).Str("payload", string(payload)).Msg("peer message")
-	if err := uc.mqtt.Publish(topic, payload); err != nil {
-		uc.log.Error().Err(err).Msg("failed to publish message")
+func (uc *SyncUseCase) OnDisconnect() {
+	if uc.srv != nil {
+		uc.srv.SetServing(false)
 	}
 }
 
+// OnMessage publishes the message received from the peer, the error means the message must be redelivered
+func (uc *SyncUseCase) OnMessage(peer string, m entity.SyncMessage) (err error) {
+	ctx, span := tracing.Tracer().Start(entity.MessageContext(m), "SyncUseCase.OnMessage", trace.WithAttributes(
+		attribute.String("messaging.destination.name", m.Topic()),
+		attribute.String("peer", peer),
+	))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	m = withTopic(m, uc.rewrite.Inbound(m.Topic()))
+
+	if uc.echo.Echo(echo.Outbound, m.Topic(), m.Payload()) {
+		uc.log.Debug().Str("peer", peer).Str("topic", m.Topic()).Msg("peer echo suppressed")
+		span.AddEvent("echo suppressed")
+		uc.observe(entity.DirectionInbound, peer, m, tap.ReasonEcho)
+		return nil
+	}
+
+	if !uc.inbound.Allow(m.Topic()) {
+		uc.log.Debug().Str("peer", peer).Str("topic", m.Topic()).Msg("inbound topic rejected")
+		span.AddEvent("topic rejected")
+		uc.observe(entity.DirectionInbound, peer, m, tap.ReasonTopicRule)
+		return nil
+	}
+
+	uc.log.Debug().
+		Str("peer", peer).
+		Str("topic", m.Topic()).
+		Uint8("qos", m.QoS()).
+		Bool("retained", m.Retained()).
+		Str("payload", payloadString(m.Payload())).
+		Msg("peer message")
+
+	payload, err := uc.transform.inbound.Transform(m.Topic(), m.Payload())
+	if err != nil {
+		uc.log.Error().Err(err).Str("topic", m.Topic()).Msg("failed to transform message")
+		uc.observe(entity.DirectionInbound, peer, m, tap.ReasonTransform)
+		return nil
+	}
+	m = withPayload(m, payload)
+
+	messages := uc.scripts.run(uc.scripts.inbound, entity.DirectionInbound, peer, m)
+	if len(messages) == 0 {
+		uc.observe(entity.DirectionInbound, peer, m, tap.ReasonScript)
+	}
+
+	for _, msg := range messages {
+		// scripts may change the topic or emit messages to other topics
+		if !uc.inbound.Allow(msg.Topic()) {
+			uc.log.Debug().Str("peer", peer).Str("topic", msg.Topic()).Msg("inbound topic of script message rejected")
+			span.AddEvent("topic rejected")
+			uc.observe(entity.DirectionInbound, peer, msg, tap.ReasonTopicRule)
+			continue
+		}
+		if uc.dedup.inbound.Unchanged(msg.Topic(), msg.Payload()) {
+			uc.log.Debug().Str("peer", peer).Str("topic", msg.Topic()).Msg("unchanged inbound message skipped")
+			metrics.Dropped(metrics.DropUnchanged)
+			span.AddEvent("unchanged message skipped")
+			uc.observe(entity.DirectionInbound, peer, msg, tap.ReasonUnchanged)
+			continue
+		}
+		msg = uc.pub.apply(msg)
+		uc.echo.Add(echo.Inbound, msg.Topic(), msg.Payload())
+		if err := uc.mqtt.Publish(entity.WithContext(msg, ctx)); err != nil {
+			// no echo is expected for the unpublished message, the redelivered one must not be skipped
+			uc.echo.Echo(echo.Inbound, msg.Topic(), msg.Payload())
+			uc.dedup.inbound.Forget(msg.Topic())
+			uc.log.Error().Err(err).Msg("failed to publish message")
+			uc.observe(entity.DirectionInbound, peer, msg, tap.ReasonPublishError)
+			return err
+		}
+		uc.observe(entity.DirectionInbound, peer, msg, "")
+	}
+
+	return nil
+}
+
 func (uc *SyncUseCase) mqttMessage(m entity.SyncMessage) {
-	if m.IsPayloadKey() {
+	ctx, span := tracing.Tracer().Start(entity.MessageContext(m), "SyncUseCase.mqttMessage", trace.WithAttributes(
+		attribute.String("messaging.destination.name", m.Topic()),
+	))
+	defer span.End()
+
+	if uc.echo.Echo(echo.Inbound, m.Topic(), m.Payload()) {
+		uc.log.Debug().Str("topic", m.Topic()).Msg("MQTT echo suppressed")
+		span.AddEvent("echo suppressed")
+		uc.observe(entity.DirectionOutbound, "", m, tap.ReasonEcho)
 		return
 	}
 
-	uc.log.Debug().Str("topic", m.Topic()).Str("payload", string(m.Payload())).Msg("MQTT message")
-
-	var err error
-	switch {
-	case uc.srv != nil:
-		err = uc.srv.Send(m)
-	case uc.cli != nil:
-		err = uc.cli.Send(m)
+	if !uc.outbound.Allow(m.Topic()) {
+		uc.log.Debug().Str("topic", m.Topic()).Msg("outbound topic rejected")
+		span.AddEvent("topic rejected")
+		uc.observe(entity.DirectionOutbound, "", m, tap.ReasonTopicRule)
+		return
 	}
+
+	uc.log.Debug().
+		Str("topic", m.Topic()).
+		Uint8("qos", m.QoS()).
+		Bool("retained", m.Retained()).
+		Str("payload", payloadString(m.Payload())).
+		Msg("MQTT message")
+	uc.echo.Add(echo.Outbound, m.Topic(), m.Payload())
+
+	payload, err := uc.transform.outbound.Transform(m.Topic(), m.Payload())
 	if err != nil {
+		uc.log.Error().Err(err).Str("topic", m.Topic()).Msg("failed to transform message")
+		uc.observe(entity.DirectionOutbound, "", m, tap.ReasonTransform)
+		return
+	}
+	m = withPayload(m, payload)
+
+	messages := uc.scripts.run(uc.scripts.outbound, entity.DirectionOutbound, "", m)
+	if len(messages) == 0 {
+		uc.observe(entity.DirectionOutbound, "", m, tap.ReasonScript)
+	}
+
+	for _, msg := range messages {
+		msg = entity.WithContext(msg, ctx)
+		// scripts may change the topic or emit messages to other topics
+		if !uc.outbound.Allow(msg.Topic()) {
+			uc.log.Debug().Str("topic", msg.Topic()).Msg("outbound topic of script message rejected")
+			span.AddEvent("topic rejected")
+			uc.observe(entity.DirectionOutbound, "", msg, tap.ReasonTopicRule)
+			continue
+		}
+		if uc.dedup.outbound.Unchanged(msg.Topic(), msg.Payload()) {
+			uc.log.Debug().Str("topic", msg.Topic()).Msg("unchanged outbound message skipped")
+			metrics.Dropped(metrics.DropUnchanged)
+			span.AddEvent("unchanged message skipped")
+			uc.observe(entity.DirectionOutbound, "", msg, tap.ReasonUnchanged)
+			continue
+		}
+		switch uc.limit.Allow(msg.Topic(), msg) {
+		case ratelimit.Suppressed:
+			// the message is dropped, so the next one with the same payload must not be skipped
+			uc.dedup.outbound.Forget(msg.Topic())
+			span.AddEvent("rate limited")
+			uc.suppressed(msg)
+		case ratelimit.Delayed:
+			uc.log.Debug().Str("topic", msg.Topic()).Msg("outbound message delayed")
+			span.AddEvent("delayed")
+		default:
+			uc.forward(msg)
+		}
+	}
+}
+
+// forward sends the message to the peer with the rewritten topic
+func (uc *SyncUseCase) forward(m entity.SyncMessage) {
+	m = withTopic(m, uc.rewrite.Outbound(m.Topic()))
+	uc.observe(entity.DirectionOutbound, "", m, "")
+
+	if uc.peers == nil {
+		return
+	}
+	if err := uc.peers.Send(m); err != nil {
 		uc.log.Error().Err(err).Msg("failed to send message")
 	}
 }
+
+func payloadString(payload []byte) string {
+	if utf8.Valid(payload) {
+		return string(payload)
+	}
+	return hex.EncodeToString(payload)
+}
@@ -0,0 +1,316 @@
+package usecase
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/forest33/mqtt-sync/adapter/mqtt"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/echo"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/ratelimit"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+)
+
+const testScript = `
+function handle(m)
+  m.payload = m.payload .. "|" .. m.topic
+  emit({topic = "secret/" .. m.direction, payload = "x"})
+  return m
+end
+`
+
+var errPublish = errors.New("broker is not available")
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string {
+	return m.topic
+}
+
+func (m *testMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m *testMessage) QoS() byte {
+	return 0
+}
+
+func (m *testMessage) Retained() bool {
+	return false
+}
+
+func (m *testMessage) Duplicate() bool {
+	return false
+}
+
+func (m *testMessage) MessageID() uint16 {
+	return 0
+}
+
+func (m *testMessage) Properties() *entity.MessageProperties {
+	return nil
+}
+
+// recorder records sent messages as topic=payload
+type recorder struct {
+	messages []string
+	sync.Mutex
+}
+
+func (r *recorder) record(m entity.SyncMessage) {
+	r.Lock()
+	r.messages = append(r.messages, m.Topic()+"="+string(m.Payload()))
+	r.Unlock()
+}
+
+func (r *recorder) take() []string {
+	r.Lock()
+	defer r.Unlock()
+	messages := r.messages
+	r.messages = nil
+	return messages
+}
+
+// testMqtt records published messages, Publish fails while fail is set
+type testMqtt struct {
+	recorder
+	fail bool
+}
+
+func (c *testMqtt) Connect() error {
+	return nil
+}
+
+func (c *testMqtt) Publish(m entity.SyncMessage) error {
+	if c.fail {
+		return errPublish
+	}
+	c.record(m)
+	return nil
+}
+
+func (c *testMqtt) Subscribe(_ string, _ byte, _ mqtt.MessageHandler) error {
+	return nil
+}
+
+func (c *testMqtt) SetConnectHandler(_ mqtt.ConnectHandler) {}
+
+func (c *testMqtt) SetDisconnectHandler(_ mqtt.DisconnectHandler) {}
+
+func (c *testMqtt) Connected() bool {
+	return true
+}
+
+func (c *testMqtt) Close() {}
+
+// testForwarder records messages sent to the peers
+type testForwarder struct {
+	recorder
+}
+
+func (f *testForwarder) Send(m entity.SyncMessage) error {
+	f.record(m)
+	return nil
+}
+
+// syncStep passes the message received from the peer (inbound) or from the broker,
+// the step without topic only waits, published, forwarded and dropped are results of the step
+type syncStep struct {
+	sleep      time.Duration
+	inbound    bool
+	topic      string
+	payload    string
+	publishErr bool
+	published  []string
+	forwarded  []string
+	dropped    []string
+}
+
+func TestSyncUseCase(t *testing.T) {
+	tests := []struct {
+		name   string
+		sync   *entity.Sync
+		limits []ratelimit.Rule
+		steps  []syncStep
+	}{
+		{
+			// transform, script, topic rules for script messages, then rewrite
+			name: "outbound stage order",
+			sync: &entity.Sync{
+				Outbound:  &entity.TopicRules{Exclude: []string{"secret/#"}},
+				Rewrite:   []*entity.RewriteRule{{Local: "home/#", Remote: "remote/home/#"}},
+				Transform: []*entity.TransformRule{{Topic: "home/#", Exclude: []string{"debug"}}},
+				Scripts:   []*entity.ScriptRule{{Topic: "home/#"}},
+			},
+			steps: []syncStep{
+				{topic: "home/sensor", payload: `{"debug":1}`, forwarded: []string{`remote/home/sensor={}|home/sensor`}, dropped: []string{tap.ReasonTopicRule}},
+				{topic: "secret/key", payload: "x", dropped: []string{tap.ReasonTopicRule}},
+			},
+		},
+		{
+			// rewrite, transform, script, topic rules for script messages
+			name: "inbound stage order",
+			sync: &entity.Sync{
+				Inbound:   &entity.TopicRules{Exclude: []string{"secret/#"}},
+				Rewrite:   []*entity.RewriteRule{{Local: "home/#", Remote: "remote/home/#"}},
+				Transform: []*entity.TransformRule{{Topic: "home/#", Direction: entity.DirectionInbound, Exclude: []string{"debug"}}},
+				Scripts:   []*entity.ScriptRule{{Topic: "home/#", Direction: entity.DirectionInbound}},
+			},
+			steps: []syncStep{
+				{inbound: true, topic: "remote/home/lamp/set", payload: `{"debug":1}`, published: []string{`home/lamp/set={}|home/lamp/set`}, dropped: []string{tap.ReasonTopicRule}},
+			},
+		},
+		{
+			name: "echo",
+			sync: &entity.Sync{},
+			steps: []syncStep{
+				{topic: "lamp", payload: "ON", forwarded: []string{"lamp=ON"}},
+				{inbound: true, topic: "lamp", payload: "ON", dropped: []string{tap.ReasonEcho}},
+				{inbound: true, topic: "lamp", payload: "ON", published: []string{"lamp=ON"}},
+				{topic: "lamp", payload: "ON", dropped: []string{tap.ReasonEcho}},
+				{topic: "lamp", payload: "ON", forwarded: []string{"lamp=ON"}},
+			},
+		},
+		{
+			name: "dedup forgets unpublished message",
+			sync: &entity.Sync{
+				Dedup: []*entity.DedupRule{{Topic: "#", Direction: entity.DirectionInbound}},
+			},
+			steps: []syncStep{
+				{inbound: true, topic: "lamp/set", payload: "ON", publishErr: true, dropped: []string{tap.ReasonPublishError}},
+				{inbound: true, topic: "lamp/set", payload: "ON", published: []string{"lamp/set=ON"}},
+				{inbound: true, topic: "lamp/set", payload: "ON", dropped: []string{tap.ReasonUnchanged}},
+			},
+		},
+		{
+			name: "rate limit suppressed",
+			sync: &entity.Sync{
+				Dedup: []*entity.DedupRule{{Topic: "#"}},
+			},
+			limits: []ratelimit.Rule{{Topic: "sensor", Mode: ratelimit.ModeLimit, Rate: 0.001, Burst: 1}},
+			steps: []syncStep{
+				{topic: "sensor", payload: "1", forwarded: []string{"sensor=1"}},
+				{topic: "sensor", payload: "2", dropped: []string{tap.ReasonRateLimit}},
+				// the suppressed message is forgotten by dedup, so it is limited again instead of skipped
+				{topic: "sensor", payload: "2", dropped: []string{tap.ReasonRateLimit}},
+				{topic: "other", payload: "1", forwarded: []string{"other=1"}},
+			},
+		},
+		{
+			name:   "rate limit delayed",
+			sync:   &entity.Sync{},
+			limits: []ratelimit.Rule{{Topic: "sensor", Mode: ratelimit.ModeThrottle, Interval: 50 * time.Millisecond}},
+			steps: []syncStep{
+				{topic: "sensor", payload: "1", forwarded: []string{"sensor=1"}},
+				{topic: "sensor", payload: "2"},
+				{topic: "sensor", payload: "3", dropped: []string{tap.ReasonRateLimit}},
+				{sleep: 150 * time.Millisecond, forwarded: []string{"sensor=3"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uc, client, peers := newTestSyncUseCase(t, tt.sync, tt.limits)
+
+			sub, err := uc.tap.Subscribe(tap.Filter{Dropped: true}, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, s := range tt.steps {
+				time.Sleep(s.sleep)
+
+				if len(s.topic) != 0 {
+					m := &testMessage{topic: s.topic, payload: []byte(s.payload)}
+					if s.inbound {
+						client.fail = s.publishErr
+						if err := uc.OnMessage("peer", m); (err != nil) != s.publishErr {
+							t.Fatalf("step %d: unexpected error %v", i, err)
+						}
+					} else {
+						uc.mqttMessage(m)
+					}
+				}
+
+				if got := client.take(); !slices.Equal(got, s.published) {
+					t.Fatalf("step %d: expected published %q, got %q", i, s.published, got)
+				}
+				if got := peers.take(); !slices.Equal(got, s.forwarded) {
+					t.Fatalf("step %d: expected forwarded %q, got %q", i, s.forwarded, got)
+				}
+				if got := takeReasons(sub); !slices.Equal(got, s.dropped) {
+					t.Fatalf("step %d: expected dropped %q, got %q", i, s.dropped, got)
+				}
+			}
+		})
+	}
+}
+
+func newTestSyncUseCase(t *testing.T, cfg *entity.Sync, limits []ratelimit.Rule) (*SyncUseCase, *testMqtt, *testForwarder) {
+	t.Helper()
+
+	cfg.PublishQoS = entity.PublishQoSKeep
+	cfg.PublishRetain = entity.PublishRetainKeep
+	if cfg.Inbound == nil {
+		cfg.Inbound = &entity.TopicRules{}
+	}
+	if cfg.Outbound == nil {
+		cfg.Outbound = &entity.TopicRules{}
+	}
+	if len(cfg.Scripts) != 0 {
+		file := filepath.Join(t.TempDir(), "test.lua")
+		if err := os.WriteFile(file, []byte(testScript), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range cfg.Scripts {
+			s.File = file
+		}
+	}
+
+	client := &testMqtt{}
+	peers := &testForwarder{}
+	uc := &SyncUseCase{
+		cfg:   &entity.Config{Sync: cfg},
+		log:   logger.New(logger.Config{Level: "disabled"}),
+		mqtt:  client,
+		peers: peers,
+		echo:  echo.New(time.Minute),
+		tap:   tap.New(),
+	}
+	if err := uc.loadRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	// intervals of the config are in seconds
+	if limits != nil {
+		var err error
+		if uc.limit, err = ratelimit.New(limits, uc.forward, uc.suppressed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(uc.limit.Close)
+
+	return uc, client, peers
+}
+
+func takeReasons(sub *tap.Subscriber) []string {
+	var reasons []string
+	for {
+		select {
+		case e := <-sub.C:
+			reasons = append(reasons, e.Reason)
+		default:
+			return reasons
+		}
+	}
+}
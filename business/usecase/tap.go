@@ -0,0 +1,32 @@
+package usecase
+
+import (
+	"time"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/tap"
+)
+
+// Tap returns the live feed of messages
+func (uc *SyncUseCase) Tap() *tap.Hub {
+	return uc.tap
+}
+
+// observe passes the message to the live feed, the reason is set for dropped messages
+func (uc *SyncUseCase) observe(direction, peer string, m entity.SyncMessage, reason string) {
+	if !uc.tap.Active() {
+		return
+	}
+
+	uc.tap.Publish(&tap.Event{
+		Time:      time.Now(),
+		Direction: direction,
+		Peer:      peer,
+		Topic:     m.Topic(),
+		Payload:   m.Payload(),
+		QoS:       m.QoS(),
+		Retained:  m.Retained(),
+		Dropped:   len(reason) != 0,
+		Reason:    reason,
+	})
+}
@@ -0,0 +1,63 @@
+package usecase
+
+import (
+	"fmt"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/pkg/transform"
+)
+
+// transformedMessage is a message with the transformed payload
+type transformedMessage struct {
+	entity.SyncMessage
+	payload []byte
+}
+
+func (m *transformedMessage) Payload() []byte {
+	return m.payload
+}
+
+// transformers payload transformation pipelines of both directions
+type transformers struct {
+	outbound *transform.Pipeline
+	inbound  *transform.Pipeline
+}
+
+func newTransformers(rules []*entity.TransformRule, c codec.Codec) (*transformers, error) {
+	t := &transformers{
+		outbound: transform.NewPipeline(),
+		inbound:  transform.NewPipeline(),
+	}
+
+	for _, r := range rules {
+		p := t.outbound
+		switch r.Direction {
+		case "", entity.DirectionOutbound:
+		case entity.DirectionInbound:
+			p = t.inbound
+		default:
+			return nil, fmt.Errorf("unknown transform direction %q for topic %s", r.Direction, r.Topic)
+		}
+
+		j, err := transform.NewJSON(c, transform.JSONOptions{
+			Include: r.Include,
+			Exclude: r.Exclude,
+			Rename:  r.Rename,
+			Set:     r.Set,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("transform rule for topic %s: %w", r.Topic, err)
+		}
+		if err := p.Add(r.Topic, j); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// withPayload returns the message with the payload
+func withPayload(m entity.SyncMessage, payload []byte) entity.SyncMessage {
+	return &transformedMessage{SyncMessage: m, payload: payload}
+}
@@ -7,10 +7,11 @@ import (
 
 type MqttClient interface {
 	Connect() error
-	Publish(topic string, payload []byte) error
-	Subscribe(topic string, handler mqtt.MessageHandler) error
+	Publish(m entity.SyncMessage) error
+	Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error
 	SetConnectHandler(h mqtt.ConnectHandler)
 	SetDisconnectHandler(h mqtt.DisconnectHandler)
+	Connected() bool
 	Close()
 }
 
@@ -25,3 +26,8 @@ type GrpcClient interface {
 	Send(m *entity.SyncMessage) error
 	SetSyncUseCase(uc entity.SyncUseCase)
 }
+
+// Forwarder sends messages to the peers, implemented by the gRPC server and client
+type Forwarder interface {
+	Send(m entity.SyncMessage) error
+}
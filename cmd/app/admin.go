@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+)
+
+// dialAdmin connects to the admin API of the running instance
+func dialAdmin(cfg *entity.Admin) (*grpc.ClientConn, error) {
+	if !cfg.Enabled {
+		return nil, errors.New("admin API is disabled")
+	}
+
+	host := cfg.Host
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	creds := insecure.NewCredentials()
+	if len(cfg.Cert) != 0 {
+		var err error
+		if creds, err = credentials.NewClientTLSFromFile(cfg.Cert, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return grpc.NewClient(net.JoinHostPort(host, strconv.Itoa(cfg.Port)), grpc.WithTransportCredentials(creds))
+}
+
+// adminContext adds the admin API token to the context
+func adminContext(ctx context.Context, cfg *entity.Admin) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+cfg.Token)
+}
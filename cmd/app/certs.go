@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/forest33/mqtt-sync/pkg/cert"
+)
+
+const (
+	day = 24 * time.Hour
+
+	defaultValidityDays = 3650
+	caFileName          = "ca"
+	serverFileName      = "server"
+	clientFileName      = "client"
+)
+
+// certFlags output and validity flags of issued certificates
+type certFlags struct {
+	dir   *string
+	days  *int
+	force *bool
+}
+
+// caFlags the CA issuing certificates
+type caFlags struct {
+	cert *string
+	key  *string
+}
+
+func addCertFlags(fs *flag.FlagSet) *certFlags {
+	return &certFlags{
+		dir:   fs.String("dir", ".", "output directory"),
+		days:  fs.Int("days", defaultValidityDays, "validity in days"),
+		force: fs.Bool("force", false, "overwrite existing files"),
+	}
+}
+
+func addCAFlags(fs *flag.FlagSet) *caFlags {
+	return &caFlags{
+		cert: fs.String("ca-cert", "", "CA certificate, <dir>/ca-cert.pem by default"),
+		key:  fs.String("ca-key", "", "CA key, <dir>/ca-key.pem by default"),
+	}
+}
+
+// certs manages the certificate authority and issues certificates, returns the exit code
+func certs(args []string) int {
+	actions := map[string]func(args []string) error{
+		"ca":     certsCA,
+		"server": certsServer,
+		"client": certsClient,
+	}
+
+	if len(args) == 0 || actions[args[0]] == nil {
+		fmt.Fprintf(os.Stderr, "usage: %s certs <ca|server|client> [flags]\n\n", binaryName())
+		fmt.Fprintln(os.Stderr, "  ca      create the certificate authority")
+		fmt.Fprintln(os.Stderr, "  server  issue a server certificate for the IP addresses and DNS names of the server")
+		fmt.Fprintln(os.Stderr, "  client  issue a client certificate, the common name is the identity of the client")
+		return 2
+	}
+
+	if err := actions[args[0]](args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func certsCA(args []string) error {
+	fs := newFlagSet("certs ca")
+	out := addCertFlags(fs)
+	cn := fs.String("cn", "mqtt-sync CA", "common name of the CA")
+	_ = fs.Parse(args)
+
+	ca, err := cert.NewCA(&cert.Request{CommonName: *cn, Validity: out.validity()})
+	if err != nil {
+		return err
+	}
+
+	certFile, keyFile, err := out.write(caFileName, ca)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("CA certificate: %s\nCA key: %s, keep it secret\n", certFile, keyFile)
+
+	return nil
+}
+
+func certsServer(args []string) error {
+	fs := newFlagSet("certs server")
+	out := addCertFlags(fs)
+	caf := addCAFlags(fs)
+	hosts := fs.String("hosts", "", "comma separated IP addresses and DNS names the clients connect to (required)")
+	name := fs.String("name", serverFileName, "file name prefix")
+	_ = fs.Parse(args)
+
+	if len(*hosts) == 0 {
+		return errors.New("-hosts is required")
+	}
+
+	ca, err := caf.load(*out.dir)
+	if err != nil {
+		return err
+	}
+
+	h := strings.Split(*hosts, ",")
+	srv, err := ca.IssueServer(&cert.Request{CommonName: h[0], Hosts: h, Validity: out.validity()})
+	if err != nil {
+		return err
+	}
+
+	certFile, keyFile, err := out.write(*name, srv)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Server:\n  UseTLS: true\n  CACert: %s\n  Cert: %s\n  Key: %s\n", caf.certFile(*out.dir), certFile, keyFile)
+
+	return nil
+}
+
+func certsClient(args []string) error {
+	fs := newFlagSet("certs client")
+	out := addCertFlags(fs)
+	caf := addCAFlags(fs)
+	cn := fs.String("cn", "", "common name, the identity of the client (required)")
+	name := fs.String("name", "", "file name prefix, the common name by default")
+	_ = fs.Parse(args)
+
+	if len(*cn) == 0 {
+		return errors.New("-cn is required")
+	}
+	if len(*name) == 0 {
+		*name = *cn
+	}
+
+	ca, err := caf.load(*out.dir)
+	if err != nil {
+		return err
+	}
+
+	cli, err := ca.IssueClient(&cert.Request{CommonName: *cn, Validity: out.validity()})
+	if err != nil {
+		return err
+	}
+
+	certFile, keyFile, err := out.write(*name, cli)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Client:\n  UseTLS: true\n  InsecureSkipVerify: false\n  CACert: %s\n  Cert: %s\n  Key: %s\n", caf.certFile(*out.dir), certFile, keyFile)
+
+	return nil
+}
+
+// genCerts generates the CA, the server and the client certificates and returns the exit code,
+// it is a shortcut for certs ca, certs server and certs client
+func genCerts(args []string) int {
+	var (
+		fs       = newFlagSet("gen-certs")
+		out      = addCertFlags(fs)
+		hosts    = fs.String("hosts", "127.0.0.1,localhost", "comma separated IP addresses and DNS names of the server")
+		clientCN = fs.String("client-cn", "mqtt-sync-client", "common name of the client certificate, the identity of the client")
+	)
+	_ = fs.Parse(args)
+
+	if err := writeCerts(out, strings.Split(*hosts, ","), *clientCN); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("certificates written to %s\n", *out.dir)
+
+	return 0
+}
+
+// writeCerts runs certs ca, certs server and certs client in order,
+// nothing is written if any of the files exists and must not be overwritten
+func writeCerts(out *certFlags, hosts []string, clientCN string) error {
+	for _, name := range []string{caFileName, serverFileName, clientFileName} {
+		if err := out.check(name); err != nil {
+			return err
+		}
+	}
+
+	common := []string{"-dir", *out.dir, "-days", strconv.Itoa(*out.days), "-force=" + strconv.FormatBool(*out.force)}
+	steps := []struct {
+		action func(args []string) error
+		args   []string
+	}{
+		{action: certsCA},
+		{action: certsServer, args: []string{"-hosts", strings.Join(hosts, ",")}},
+		{action: certsClient, args: []string{"-cn", clientCN, "-name", clientFileName}},
+	}
+
+	for _, step := range steps {
+		if err := step.action(append(slices.Clone(common), step.args...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *certFlags) validity() time.Duration {
+	return time.Duration(*f.days) * day
+}
+
+func (f *certFlags) files(name string) (string, string) {
+	return filepath.Join(*f.dir, name+"-cert.pem"), filepath.Join(*f.dir, name+"-key.pem")
+}
+
+// check fails if the files of the certificate exist and must not be overwritten
+func (f *certFlags) check(name string) error {
+	if *f.force {
+		return nil
+	}
+
+	certFile, keyFile := f.files(name)
+	for _, file := range []string{certFile, keyFile} {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite", file)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write writes the certificate and the key to the output directory
+func (f *certFlags) write(name string, p *cert.Pair) (string, string, error) {
+	if err := f.check(name); err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(*f.dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	certFile, keyFile := f.files(name)
+	if err := p.Write(certFile, keyFile); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+func (f *caFlags) certFile(dir string) string {
+	if len(*f.cert) != 0 {
+		return *f.cert
+	}
+	return filepath.Join(dir, caFileName+"-cert.pem")
+}
+
+func (f *caFlags) load(dir string) (*cert.Pair, error) {
+	keyFile := *f.key
+	if len(keyFile) == 0 {
+		keyFile = filepath.Join(dir, caFileName+"-key.pem")
+	}
+
+	ca, err := cert.Load(f.certFile(dir), keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+	if !ca.Cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", f.certFile(dir))
+	}
+
+	return ca, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/pkg/config"
+)
+
+// configFlags selects the config file and overrides its settings
+type configFlags struct {
+	path      string
+	overrides []func(cfg *entity.Config)
+}
+
+func binaryName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s %s [flags]\n\nflags:\n", binaryName(), name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// addConfigFlags adds the config file flag and flags overriding settings of the config file
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{}
+
+	fs.StringVar(&f.path, "config", "", "config file, "+config.EnvPath+" is used if not set")
+
+	f.string(fs, "log-level", "Logger.Level", func(cfg *entity.Config, v string) { cfg.Logger.Level = v })
+	f.string(fs, "mqtt-host", "MQTT.Host", func(cfg *entity.Config, v string) { cfg.MQTT.Host = v })
+	f.int(fs, "mqtt-port", "MQTT.Port", func(cfg *entity.Config, v int) { cfg.MQTT.Port = v })
+	f.string(fs, "mqtt-client-id", "MQTT.ClientID", func(cfg *entity.Config, v string) { cfg.MQTT.ClientID = v })
+	f.bool(fs, "server", "Server.Enabled", func(cfg *entity.Config, v bool) { cfg.Server.Enabled = v })
+	f.string(fs, "server-host", "Server.Host", func(cfg *entity.Config, v string) { cfg.Server.Host = v })
+	f.int(fs, "server-port", "Server.Port", func(cfg *entity.Config, v int) { cfg.Server.Port = v })
+	f.bool(fs, "client", "Client.Enabled", func(cfg *entity.Config, v bool) { cfg.Client.Enabled = v })
+	f.string(fs, "client-host", "Client.Host", func(cfg *entity.Config, v string) { cfg.Client.Host = v })
+	f.int(fs, "client-port", "Client.Port", func(cfg *entity.Config, v int) { cfg.Client.Port = v })
+	f.string(fs, "peer-id", "Client.PeerID", func(cfg *entity.Config, v string) { cfg.Client.PeerID = v })
+	f.bool(fs, "monitoring", "Monitoring.Enabled", func(cfg *entity.Config, v bool) { cfg.Monitoring.Enabled = v })
+	f.int(fs, "monitoring-port", "Monitoring.Port", func(cfg *entity.Config, v int) { cfg.Monitoring.Port = v })
+	f.bool(fs, "admin", "Admin.Enabled", func(cfg *entity.Config, v bool) { cfg.Admin.Enabled = v })
+	f.int(fs, "admin-port", "Admin.Port", func(cfg *entity.Config, v int) { cfg.Admin.Port = v })
+
+	return f
+}
+
+// load reads the config file and applies overrides in the order of the flags
+func (f *configFlags) load() (*entity.Config, error) {
+	_, cfg, err := entity.LoadConfig(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range f.overrides {
+		o(cfg)
+	}
+
+	return cfg, nil
+}
+
+func (f *configFlags) string(fs *flag.FlagSet, name, setting string, set func(cfg *entity.Config, v string)) {
+	fs.Func(name, "overrides "+setting, func(v string) error {
+		f.overrides = append(f.overrides, func(cfg *entity.Config) { set(cfg, v) })
+		return nil
+	})
+}
+
+func (f *configFlags) int(fs *flag.FlagSet, name, setting string, set func(cfg *entity.Config, v int)) {
+	fs.Func(name, "overrides "+setting, func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		f.overrides = append(f.overrides, func(cfg *entity.Config) { set(cfg, n) })
+		return nil
+	})
+}
+
+func (f *configFlags) bool(fs *flag.FlagSet, name, setting string, set func(cfg *entity.Config, v bool)) {
+	fs.BoolFunc(name, "overrides "+setting, func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		f.overrides = append(f.overrides, func(cfg *entity.Config) { set(cfg, b) })
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/forest33/mqtt-sync/pkg/cert"
+)
+
+func TestConfigFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("MQTT:\n  Host: broker\n  Port: 1884\nSync:\n  Topics:\n    - home/#\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := newFlagSet("test")
+	flags := addConfigFlags(fs)
+	if err := fs.Parse([]string{"--config", path, "-mqtt-port", "1999", "-server", "-server-port=4000", "-log-level", "info"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := flags.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MQTT.Host != "broker" || cfg.MQTT.Port != 1999 || !cfg.Server.Enabled || cfg.Server.Port != 4000 || cfg.Logger.Level != "info" {
+		t.Fatalf("overrides are not applied: %+v %+v %+v", cfg.MQTT, cfg.Server, cfg.Logger)
+	}
+	if cfg.Client.Port != 31883 {
+		t.Fatalf("default value is not set: %d", cfg.Client.Port)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteCerts(t *testing.T) {
+	fs := newFlagSet("test")
+	out := addCertFlags(fs)
+	if err := fs.Parse([]string{"-dir", t.TempDir(), "-days", "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeCerts(out, []string{"127.0.0.1"}, "home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCerts(out, []string{"127.0.0.1"}, "home"); err == nil {
+		t.Fatal("existing certificates overwritten")
+	}
+	*out.force = true
+	if err := writeCerts(out, []string{"127.0.0.1"}, "home"); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := cert.Load(out.files(clientFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := cert.Load(out.files(caFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.Cert.Subject.CommonName != "home" || cli.Cert.CheckSignatureFrom(ca.Cert) != nil {
+		t.Fatalf("client certificate %q is not issued by the CA", cli.Cert.Subject.CommonName)
+	}
+}
+
+func TestCerts(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, args := range [][]string{
+		{"ca", "-dir", dir},
+		{"server", "-dir", dir, "-hosts", "127.0.0.1,vps.example.com"},
+		{"client", "-dir", dir, "-cn", "home-a"},
+	} {
+		if code := certs(args); code != 0 {
+			t.Fatalf("certs %v: exit code %d", args, code)
+		}
+	}
+
+	for _, file := range []string{"ca-cert.pem", "ca-key.pem", "server-cert.pem", "server-key.pem", "home-a-cert.pem", "home-a-key.pem"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := certs([]string{"client", "-dir", dir, "-cn", "home-a"}); code == 0 {
+		t.Fatal("existing certificate overwritten")
+	}
+	if code := certs([]string{"server", "-dir", t.TempDir(), "-hosts", "127.0.0.1"}); code == 0 {
+		t.Fatal("certificate issued without CA")
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	for addr, want := range map[string]struct {
+		host string
+		port int
+	}{
+		"vps.example.com":      {"vps.example.com", defaultServerPort},
+		"203.0.113.10:4000":    {"203.0.113.10", 4000},
+		"[2001:db8::1]:31883":  {"2001:db8::1", 31883},
+		"vps.example.com:3188": {"vps.example.com", 3188},
+	} {
+		host, port, err := splitHostPort(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host != want.host || port != want.port {
+			t.Fatalf("%s: got %s %d", addr, host, port)
+		}
+	}
+
+	if _, _, err := splitHostPort("vps.example.com:port"); err == nil {
+		t.Fatal("invalid port accepted")
+	}
+}
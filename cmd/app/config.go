@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/forest33/mqtt-sync/adapter/grpc"
+	"github.com/forest33/mqtt-sync/business/usecase"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+)
+
+const (
+	redacted = "<redacted>"
+)
+
+// validateConfig checks the config file, topic rules, scripts and queue policies and returns the exit code
+func validateConfig(args []string) int {
+	fs := newFlagSet("validate-config")
+	flags := addConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	err = errors.Join(
+		cfg.Validate(),
+		usecase.ValidateConfig(cfg, logger.New(logger.Config{Level: "disabled"})),
+		grpc.ValidateQueueConfig(newQueueConfig(cfg)),
+	)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("config is valid")
+
+	return 0
+}
+
+// printConfig prints the effective config after defaults and overrides are applied and returns the exit code
+func printConfig(args []string) int {
+	fs := newFlagSet("print-config")
+	flags := addConfigFlags(fs)
+	secrets := fs.Bool("secrets", false, "print passwords and tokens")
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*secrets {
+		if len(cfg.MQTT.Password) != 0 {
+			cfg.MQTT.Password = redacted
+		}
+		if len(cfg.Admin.Token) != 0 {
+			cfg.Admin.Token = redacted
+		}
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
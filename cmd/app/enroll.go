@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/forest33/mqtt-sync/adapter/grpc"
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+)
+
+const (
+	defaultServerPort = 31883
+	defaultEnrollTTL  = 24 * time.Hour
+)
+
+// enrollToken creates the one-time enrollment token on the running server and returns the exit code
+func enrollToken(args []string) int {
+	var (
+		fs    = newFlagSet("enroll-token")
+		flags = addConfigFlags(fs)
+		cn    = fs.String("cn", "", "common name of the client certificate, the identity of the client (required)")
+		ttl   = fs.Duration("ttl", defaultEnrollTTL, "validity of the token")
+	)
+	_ = fs.Parse(args)
+
+	if len(*cn) == 0 {
+		fmt.Fprintln(os.Stderr, "-cn is required")
+		return 2
+	}
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	conn, err := dialAdmin(cfg.Admin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(adminContext(context.Background(), cfg.Admin), statusTimeout)
+	defer cancel()
+
+	resp, err := apiV1.NewAdminClient(conn).CreateEnrollmentToken(ctx, &apiV1.CreateEnrollmentTokenRequest{
+		CommonName: *cn,
+		Ttl:        uint32(ttl.Seconds()),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("token: %s\nexpires: %s\n\nrun on the client:\n  %s enroll --server <host> --token %s\n",
+		resp.Token, time.Unix(0, resp.ExpiresAt).Format(time.RFC3339), binaryName(), resp.Token)
+
+	return 0
+}
+
+// enroll requests the client certificate from the server with the one-time token and returns the exit code
+func enroll(args []string) int {
+	var (
+		fs     = newFlagSet("enroll")
+		server = fs.String("server", "", "host[:port] of the server (required)")
+		token  = fs.String("token", "", "one-time token created by the administrator of the server (required)")
+		name   = fs.String("name", clientFileName, "file name prefix")
+		out    = &certFlags{
+			dir:   fs.String("dir", ".", "output directory"),
+			force: fs.Bool("force", false, "overwrite existing files"),
+		}
+	)
+	_ = fs.Parse(args)
+
+	if len(*server) == 0 || len(*token) == 0 {
+		fmt.Fprintln(os.Stderr, "-server and -token are required")
+		return 2
+	}
+
+	host, port, err := splitHostPort(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	for _, n := range []string{caFileName, *name} {
+		if err := out.check(n); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	e, err := grpc.Enroll(context.Background(), &grpc.EnrollConfig{Host: host, Port: port, Token: *token})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	certFile, keyFile, err := out.write(*name, e.Pair)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	caFile := filepath.Join(*out.dir, caFileName+"-cert.pem")
+	if err := os.WriteFile(caFile, e.CA, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Printf("enrolled as %s, certificate expires %s\n\n", e.Pair.Cert.Subject.CommonName, e.Pair.Cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("Client:\n  Enabled: true\n  Host: %s\n  Port: %d\n  UseTLS: true\n  InsecureSkipVerify: false\n  CACert: %s\n  Cert: %s\n  Key: %s\n",
+		host, port, caFile, certFile, keyFile)
+
+	return 0
+}
+
+// splitHostPort splits the address, the default port of the server is used if the port is omitted
+func splitHostPort(addr string) (string, int, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		var ae *net.AddrError
+		if errors.As(err, &ae) && ae.Err == "missing port in address" {
+			return addr, defaultServerPort, nil
+		}
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", p)
+	}
+
+	return host, port, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	healthcheckTimeout = 5 * time.Second
+)
+
+// healthcheck requests the readiness endpoint of the running instance and returns the exit code
+func healthcheck(args []string) int {
+	fs := newFlagSet("healthcheck")
+	flags := addConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !cfg.Monitoring.Enabled {
+		fmt.Fprintln(os.Stderr, "monitoring server is disabled")
+		return 1
+	}
+
+	host := cfg.Monitoring.Host
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	client := &http.Client{Timeout: healthcheckTimeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/readyz", net.JoinHostPort(host, strconv.Itoa(cfg.Monitoring.Port))))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "not ready: %s\n", resp.Status)
+		return 1
+	}
+
+	return 0
+}
@@ -1,115 +1,58 @@
 package main
 
 import (
-	"context"
-	"log"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/forest33/mqtt-sync/adapter/grpc"
-	"github.com/forest33/mqtt-sync/adapter/mqtt"
-	"github.com/forest33/mqtt-sync/business/entity"
-	"github.com/forest33/mqtt-sync/business/usecase"
-	"github.com/forest33/mqtt-sync/pkg/automaxprocs"
-	"github.com/forest33/mqtt-sync/pkg/codec"
-	"github.com/forest33/mqtt-sync/pkg/logger"
+	"strings"
 )
 
-func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		<-ctx.Done()
-		cancel()
-	}()
-
-	ctx = entity.CreateWg(ctx)
-
-	_, cfg, err := entity.GetConfig()
-	if err != nil {
-		log.Fatal(err)
-	}
+// command subcommand of the binary, run returns the exit code
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
 
-	l := logger.New(logger.Config{
-		Level:             cfg.Logger.Level,
-		TimeFormat:        cfg.Logger.TimeFormat,
-		PrettyPrint:       cfg.Logger.PrettyPrint,
-		RedirectStdLogger: cfg.Logger.RedirectStdLogger,
-		DisableSampling:   cfg.Logger.DisableSampling,
-		ErrorStack:        cfg.Logger.ErrorStack,
-	})
+var commands = []*command{
+	{name: "run", usage: "start the synchronization (default)", run: run},
+	{name: "validate-config", usage: "check the config file and its rules", run: validateConfig},
+	{name: "print-config", usage: "print the effective config with default values", run: printConfig},
+	{name: "status", usage: "show peers, queues and subscriptions of the running instance", run: printStatus},
+	{name: "tap", usage: "print the live feed of messages of the running instance", run: tap},
+	{name: "healthcheck", usage: "exit with a non-zero code when the running instance is not ready", run: healthcheck},
+	{name: "certs", usage: "create the CA, issue server and client certificates", run: certs},
+	{name: "enroll-token", usage: "create a one-time token for the enrollment of a client", run: enrollToken},
+	{name: "enroll", usage: "request the client certificate from the server with the one-time token", run: enroll},
+	{name: "gen-certs", usage: "generate a CA, a server and a client certificate", run: genCerts},
+	{name: "version", usage: "print the version", run: version},
+}
 
-	if err := automaxprocs.Init(cfg, l); err != nil {
-		l.Fatal(err)
+func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) != 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	mqttClient, err := mqtt.New(ctx, &mqtt.Config{
-		Host:                 cfg.MQTT.Host,
-		Port:                 cfg.MQTT.Port,
-		ClientID:             cfg.MQTT.ClientID,
-		User:                 cfg.MQTT.User,
-		Password:             cfg.MQTT.Password,
-		UseTLS:               cfg.MQTT.UseTLS,
-		ServerTLS:            cfg.MQTT.ServerTLS,
-		CACert:               cfg.MQTT.CACert,
-		Cert:                 cfg.MQTT.Cert,
-		Key:                  cfg.MQTT.Key,
-		InsecureSkipVerify:   false,
-		ConnectRetryInterval: time.Duration(cfg.MQTT.ConnectRetryInterval) * time.Second,
-		Timeout:              time.Duration(cfg.MQTT.Timeout) * time.Second,
-		PayloadKey:           cfg.Sync.PayloadKey,
-	}, l, codec.NewFastJsonCodec())
-	if err != nil {
-		l.Fatal(err)
+	if name == "help" {
+		usage()
+		return
 	}
 
-	var (
-		srv *grpc.Server
-		cli *grpc.Client
-	)
-
-	if cfg.Server.Enabled {
-		srv, err = grpc.NewServer(ctx, &grpc.Config{
-			Host:                         cfg.Server.Host,
-			Port:                         cfg.Server.Port,
-			UseTLS:                       cfg.Server.UseTLS,
-			CACert:                       cfg.Server.CACert,
-			Cert:                         cfg.Server.Cert,
-			Key:                          cfg.Server.Key,
-			KeepalivePingMinTime:         cfg.Server.Keepalive.PingMinTime,
-			KeepaliveTime:                cfg.Server.Keepalive.Time,
-			KeepaliveTimeout:             cfg.Server.Keepalive.Timeout,
-			KeepalivePermitWithoutStream: cfg.Server.Keepalive.PermitWithoutStream,
-		}, l)
-		if err != nil {
-			l.Fatal(err)
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(args))
 		}
 	}
 
-	if cfg.Client.Enabled {
-		cli, err = grpc.NewClient(ctx, &grpc.Config{
-			Host:                         cfg.Client.Host,
-			Port:                         cfg.Client.Port,
-			UseTLS:                       cfg.Client.UseTLS,
-			CACert:                       cfg.Client.CACert,
-			Cert:                         cfg.Client.Cert,
-			Key:                          cfg.Client.Key,
-			InsecureSkipVerify:           cfg.Client.InsecureSkipVerify,
-			ConnectRetryInterval:         time.Duration(cfg.Client.ConnectRetryInterval) * time.Second,
-			KeepaliveTime:                cfg.Client.Keepalive.Time,
-			KeepaliveTimeout:             cfg.Client.Keepalive.Timeout,
-			KeepalivePermitWithoutStream: cfg.Client.Keepalive.PermitWithoutStream,
-		}, l)
-		if err != nil {
-			l.Fatal(err)
-		}
-	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	_, err = usecase.NewSyncUseCase(ctx, cfg, l, mqttClient, srv, cli)
-	if err != nil {
-		l.Fatal(err)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", binaryName())
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", c.name, c.usage)
 	}
-
-	entity.GetWg(ctx).Wait()
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of the command\n", binaryName())
 }
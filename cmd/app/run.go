@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/forest33/mqtt-sync/adapter/grpc"
+	"github.com/forest33/mqtt-sync/adapter/monitoring"
+	"github.com/forest33/mqtt-sync/adapter/mqtt"
+	"github.com/forest33/mqtt-sync/business/entity"
+	"github.com/forest33/mqtt-sync/business/usecase"
+	"github.com/forest33/mqtt-sync/pkg/automaxprocs"
+	"github.com/forest33/mqtt-sync/pkg/health"
+	"github.com/forest33/mqtt-sync/pkg/logger"
+	"github.com/forest33/mqtt-sync/pkg/metrics"
+	"github.com/forest33/mqtt-sync/pkg/tracing"
+)
+
+// run starts the synchronization and returns the exit code when it is stopped
+func run(args []string) int {
+	fs := newFlagSet("run")
+	flags := addConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	defer cancel()
+
+	ctx = entity.CreateWg(ctx)
+
+	l := logger.New(logger.Config{
+		Level:             cfg.Logger.Level,
+		TimeFormat:        cfg.Logger.TimeFormat,
+		PrettyPrint:       cfg.Logger.PrettyPrint,
+		RedirectStdLogger: cfg.Logger.RedirectStdLogger,
+		DisableSampling:   cfg.Logger.DisableSampling,
+		ErrorStack:        cfg.Logger.ErrorStack,
+	})
+
+	if err := automaxprocs.Init(cfg, l); err != nil {
+		l.Fatal(err)
+	}
+
+	if cfg.Tracing.Enabled {
+		if err := tracing.Init(ctx, &tracing.Config{
+			Endpoint:    cfg.Tracing.Endpoint,
+			Insecure:    !cfg.Tracing.UseTLS,
+			ServiceName: cfg.Tracing.ServiceName,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		}, l); err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	mqttCfg := &mqtt.Config{
+		Host:                 cfg.MQTT.Host,
+		Port:                 cfg.MQTT.Port,
+		ClientID:             cfg.MQTT.ClientID,
+		ProtocolVersion:      cfg.MQTT.ProtocolVersion,
+		User:                 cfg.MQTT.User,
+		Password:             cfg.MQTT.Password,
+		UseTLS:               cfg.MQTT.UseTLS,
+		ServerTLS:            cfg.MQTT.ServerTLS,
+		CACert:               cfg.MQTT.CACert,
+		Cert:                 cfg.MQTT.Cert,
+		Key:                  cfg.MQTT.Key,
+		InsecureSkipVerify:   false,
+		ConnectRetryInterval: time.Duration(cfg.MQTT.ConnectRetryInterval) * time.Second,
+		Timeout:              time.Duration(cfg.MQTT.Timeout) * time.Second,
+	}
+
+	var mqttClient usecase.MqttClient
+	if cfg.MQTT.ProtocolVersion == mqtt.ProtocolVersionV5 {
+		mqttClient, err = mqtt.NewV5(ctx, mqttCfg, l)
+	} else {
+		mqttClient, err = mqtt.New(ctx, mqttCfg, l)
+	}
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	var (
+		srv *grpc.Server
+		cli *grpc.Client
+	)
+
+	queueCfg := newQueueConfig(cfg)
+
+	if cfg.Server.Enabled {
+		srv, err = grpc.NewServer(ctx, &grpc.Config{
+			Host:                         cfg.Server.Host,
+			Port:                         cfg.Server.Port,
+			UseTLS:                       cfg.Server.UseTLS,
+			CACert:                       cfg.Server.CACert,
+			Cert:                         cfg.Server.Cert,
+			Key:                          cfg.Server.Key,
+			CAKey:                        enrollmentKey(cfg.Server.Enrollment),
+			EnrollmentValidity:           time.Duration(cfg.Server.Enrollment.Validity) * 24 * time.Hour,
+			KeepalivePingMinTime:         cfg.Server.Keepalive.PingMinTime,
+			KeepaliveTime:                cfg.Server.Keepalive.Time,
+			KeepaliveTimeout:             cfg.Server.Keepalive.Timeout,
+			KeepalivePermitWithoutStream: cfg.Server.Keepalive.PermitWithoutStream,
+			PeerIDSource:                 cfg.Server.PeerIDSource,
+			TopicPrefix:                  cfg.Server.TopicPrefix,
+			Reflection:                   cfg.Server.Reflection,
+			Queue:                        queueCfg,
+		}, l)
+		if err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	if cfg.Client.Enabled {
+		cli, err = grpc.NewClient(ctx, &grpc.Config{
+			Host:                         cfg.Client.Host,
+			Port:                         cfg.Client.Port,
+			UseTLS:                       cfg.Client.UseTLS,
+			CACert:                       cfg.Client.CACert,
+			Cert:                         cfg.Client.Cert,
+			Key:                          cfg.Client.Key,
+			InsecureSkipVerify:           cfg.Client.InsecureSkipVerify,
+			ConnectRetryInterval:         time.Duration(cfg.Client.ConnectRetryInterval) * time.Second,
+			KeepaliveTime:                cfg.Client.Keepalive.Time,
+			KeepaliveTimeout:             cfg.Client.Keepalive.Timeout,
+			KeepalivePermitWithoutStream: cfg.Client.Keepalive.PermitWithoutStream,
+			Topics:                       cfg.Sync.Topics,
+			PeerID:                       cfg.Client.PeerID,
+			Queue:                        queueCfg,
+		}, l)
+		if err != nil {
+			l.Fatal(err)
+		}
+	}
+
+	metrics.SetTopicLevels(cfg.Monitoring.TopicLevels)
+	if cfg.Monitoring.Enabled {
+		mon, err := monitoring.NewServer(ctx, &monitoring.Config{
+			Host: cfg.Monitoring.Host,
+			Port: cfg.Monitoring.Port,
+		}, l)
+		if err != nil {
+			l.Fatal(err)
+		}
+		mon.SetHealth(newHealth(mqttClient, srv, cli))
+		mon.Start()
+	}
+
+	var adm *grpc.AdminServer
+	if cfg.Admin.Enabled {
+		adm, err = grpc.NewAdminServer(ctx, &grpc.AdminConfig{
+			Host:          cfg.Admin.Host,
+			Port:          cfg.Admin.Port,
+			Token:         cfg.Admin.Token,
+			Cert:          cfg.Admin.Cert,
+			Key:           cfg.Admin.Key,
+			Subscriptions: subscriptions(cfg.Sync),
+		}, l)
+		if err != nil {
+			l.Fatal(err)
+		}
+		if srv != nil {
+			adm.SetServer(srv)
+		}
+		if cli != nil {
+			adm.SetClient(cli)
+		}
+	}
+
+	uc, err := usecase.NewSyncUseCase(ctx, cfg, l, mqttClient, srv, cli)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	if adm != nil {
+		adm.SetTap(uc.Tap())
+		adm.Start()
+	}
+
+	entity.GetWg(ctx).Wait()
+
+	return 0
+}
+
+// newQueueConfig returns queue settings of the server and the client
+func newQueueConfig(cfg *entity.Config) *grpc.QueueConfig {
+	queueCfg := &grpc.QueueConfig{
+		Persistent:  cfg.Queue.Persistent,
+		Dir:         cfg.Queue.Dir,
+		SegmentSize: cfg.Queue.SegmentSize,
+		MaxSize:     cfg.Queue.MaxSize,
+		MaxAge:      time.Duration(cfg.Queue.MaxAge) * time.Second,
+		DropPolicy:  cfg.Queue.DropPolicy,
+		DefaultMode: cfg.Sync.QueueMode,
+		Policies:    make([]grpc.QueuePolicy, 0, len(cfg.Sync.QueuePolicies)),
+	}
+	for _, p := range cfg.Sync.QueuePolicies {
+		queueCfg.Policies = append(queueCfg.Policies, grpc.QueuePolicy{
+			Topic: p.Topic,
+			Mode:  p.Mode,
+			Limit: p.Limit,
+		})
+	}
+
+	return queueCfg
+}
+
+// enrollmentKey returns the CA key if the enrollment is enabled
+func enrollmentKey(cfg *entity.Enrollment) string {
+	if !cfg.Enabled {
+		return ""
+	}
+	return cfg.CAKey
+}
+
+// newHealth creates readiness checks of the MQTT connection and the gRPC server or stream
+func newHealth(mqttClient usecase.MqttClient, srv *grpc.Server, cli *grpc.Client) *health.Status {
+	h := health.New()
+	h.Add("mqtt", mqttClient.Connected)
+	if srv != nil {
+		h.Add("grpc_server", srv.Serving)
+	}
+	if cli != nil {
+		h.Add("grpc_client", cli.Connected)
+	}
+	return h
+}
+
+// subscriptions returns the topics subscribed on the local broker
+func subscriptions(cfg *entity.Sync) []grpc.Subscription {
+	subs := make([]grpc.Subscription, 0, len(cfg.Topics))
+	for _, t := range cfg.Topics {
+		subs = append(subs, grpc.Subscription{Topic: t, QoS: cfg.SubscribeQoS[t]})
+	}
+	return subs
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+)
+
+const (
+	statusTimeout = 5 * time.Second
+)
+
+// printStatus prints peers, queues and subscriptions of the running instance and returns the exit code
+func printStatus(args []string) int {
+	fs := newFlagSet("status")
+	flags := addConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	conn, err := dialAdmin(cfg.Admin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(adminContext(context.Background(), cfg.Admin), statusTimeout)
+	defer cancel()
+
+	client := apiV1.NewAdminClient(conn)
+
+	peers, err := client.ListPeers(ctx, &apiV1.ListPeersRequest{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	queues, err := client.ListQueues(ctx, &apiV1.ListQueuesRequest{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	subs, err := client.ListSubscriptions(ctx, &apiV1.ListSubscriptionsRequest{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "PEERS")
+	fmt.Fprintln(w, "ID\tNAME\tADDRESS\tCONNECTED\tSENT\tRECEIVED\tUNACKED\tTOPICS")
+	for _, p := range peers.Peers {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n",
+			p.Id, p.Name, p.Address,
+			time.Unix(0, p.ConnectedAt).Format(time.RFC3339),
+			p.MessagesSent, p.MessagesReceived, p.Unacked,
+			strings.Join(p.Topics, ","))
+	}
+
+	fmt.Fprintln(w, "\nQUEUES")
+	fmt.Fprintln(w, "NAME\tLENGTH")
+	for _, q := range queues.Queues {
+		fmt.Fprintf(w, "%s\t%d\n", q.Name, q.Length)
+	}
+
+	fmt.Fprintln(w, "\nSUBSCRIPTIONS")
+	fmt.Fprintln(w, "TOPIC\tQOS")
+	for _, s := range subs.Subscriptions {
+		fmt.Fprintf(w, "%s\t%d\n", s.Topic, s.Qos)
+	}
+
+	if err := w.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	apiV1 "github.com/forest33/mqtt-sync/api/v1"
+)
+
+// topicFlags repeatable topic filter flag
+type topicFlags []string
+
+func (f *topicFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *topicFlags) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// tap prints the live feed of messages of the running instance until interrupted and returns the exit code
+func tap(args []string) int {
+	var (
+		topics    topicFlags
+		fs        = newFlagSet("tap")
+		flags     = addConfigFlags(fs)
+		direction = fs.String("direction", "", "inbound or outbound, both directions by default")
+		peer      = fs.String("peer", "", "sending peer of inbound messages")
+		dropped   = fs.Bool("dropped", false, "only messages dropped by a rule")
+	)
+	fs.Var(&topics, "topic", "topic filter, may be repeated")
+	_ = fs.Parse(args)
+
+	cfg, err := flags.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conn, err := dialAdmin(cfg.Admin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx = adminContext(ctx, cfg.Admin)
+	stream, err := apiV1.NewAdminClient(conn).Tap(ctx, &apiV1.TapRequest{
+		Topics:      topics,
+		Direction:   *direction,
+		Peer:        *peer,
+		DroppedOnly: *dropped,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var lost uint64
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+				return 0
+			}
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if e.Lost != lost {
+			fmt.Fprintf(os.Stderr, "%d messages lost\n", e.Lost-lost)
+			lost = e.Lost
+		}
+
+		fmt.Println(formatTapEvent(e))
+	}
+}
+
+func formatTapEvent(e *apiV1.TapEvent) string {
+	var sb strings.Builder
+
+	sb.WriteString(time.Unix(0, e.Time).Format(time.RFC3339Nano))
+	sb.WriteString(" ")
+	sb.WriteString(e.Direction)
+	if len(e.Peer) != 0 {
+		sb.WriteString(" peer=")
+		sb.WriteString(e.Peer)
+	}
+	fmt.Fprintf(&sb, " qos=%d retained=%v", e.Qos, e.Retained)
+	if e.Dropped {
+		sb.WriteString(" dropped=")
+		sb.WriteString(e.Reason)
+	}
+	sb.WriteString(" ")
+	sb.WriteString(e.Topic)
+	sb.WriteString(" ")
+	if utf8.Valid(e.Payload) {
+		sb.Write(e.Payload)
+	} else {
+		sb.WriteString(hex.EncodeToString(e.Payload))
+	}
+
+	return sb.String()
+}
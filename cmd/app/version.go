@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/forest33/mqtt-sync/pkg/build"
+)
+
+// version prints build information and returns the exit code
+func version(args []string) int {
+	fs := newFlagSet("version")
+	_ = fs.Parse(args)
+
+	info := build.Get()
+	fmt.Printf("%s %s\n", binaryName(), info.Version)
+	if len(info.Commit) != 0 {
+		fmt.Printf("commit: %s\n", info.Commit)
+	}
+	if len(info.Date) != 0 {
+		fmt.Printf("date: %s\n", info.Date)
+	}
+	fmt.Printf("go: %s\n", info.GoVersion)
+
+	return 0
+}
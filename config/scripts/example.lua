@@ -0,0 +1,23 @@
+-- handle is called for every message matching the script topic filter.
+-- Return the message table to forward it, true to forward it unchanged or nil to drop it,
+-- emit(message) forwards an additional message.
+function handle(m)
+  local data = json.decode(m.payload)
+  if data == nil then
+    return true
+  end
+
+  -- drop the message while the device is not reporting the state
+  if data.state == nil then
+    return nil
+  end
+
+  -- send the temperature as a separate retained topic in Fahrenheit
+  if data.temperature ~= nil then
+    emit({topic = m.topic .. "/temperature_f", payload = tostring(data.temperature * 9 / 5 + 32), retained = true})
+  end
+
+  data.linkquality = nil
+  m.payload = json.encode(data)
+  return m
+end
@@ -1,3 +1,47 @@
 package build
 
+import (
+	"runtime"
+	"runtime/debug"
+)
+
 var EnvPrefix string
+
+// Version, Commit and Date are set at build time:
+// go build -ldflags "-X github.com/forest33/mqtt-sync/pkg/build.Version=v1.0.0"
+var (
+	Version = "dev"
+	Commit  string
+	Date    string
+)
+
+// Info build information of the binary
+type Info struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// Get returns build information, the commit and date are taken from the VCS stamp when not set at build time
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && len(info.Commit) == 0:
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && len(info.Date) == 0:
+				info.Date = s.Value
+			}
+		}
+	}
+
+	return info
+}
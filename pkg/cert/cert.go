@@ -0,0 +1,256 @@
+// Package cert generates keys and certificates for mutual TLS between the server and clients
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	serialBits = 128
+	// clockSkew certificates are valid since a moment before they are issued
+	clockSkew = time.Hour
+)
+
+// Pair certificate with its private key
+type Pair struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Request subject and validity of the certificate, Hosts are IP addresses or DNS names of the server
+type Request struct {
+	CommonName string
+	Hosts      []string
+	Validity   time.Duration
+}
+
+// NewCA creates a self-signed certificate authority
+func NewCA(req *Request) (*Pair, error) {
+	tmpl, err := newTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	return issue(tmpl, nil)
+}
+
+// IssueServer issues a server certificate for the hosts
+func (ca *Pair) IssueServer(req *Request) (*Pair, error) {
+	if len(req.Hosts) == 0 {
+		return nil, fmt.Errorf("no hosts for the server certificate %s", req.CommonName)
+	}
+
+	tmpl, err := newTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	return issue(tmpl, ca)
+}
+
+// IssueClient issues a client certificate, the server identifies the client by the common name
+func (ca *Pair) IssueClient(req *Request) (*Pair, error) {
+	tmpl, err := newClientTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return issue(tmpl, ca)
+}
+
+// ParseRequest parses the DER encoded certificate signing request and checks its signature
+func ParseRequest(der []byte) (*x509.CertificateRequest, error) {
+	cr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// SignClient issues a client certificate for the key of the certificate signing request,
+// the subject of the request is replaced by the common name
+func (ca *Pair) SignClient(cr *x509.CertificateRequest, req *Request) (*x509.Certificate, error) {
+	tmpl, err := newClientTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, cr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// NewRequest generates the key and the DER encoded certificate signing request
+func NewRequest() (crypto.Signer, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, csr, nil
+}
+
+// Fingerprint returns the hex encoded SHA-256 hash of the certificate
+func Fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Encode returns the PEM encoded certificate
+func Encode(c *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+}
+
+// Decode parses PEM encoded certificates
+func Decode(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// Load reads the PEM encoded certificate and key, e.g. of the CA issuing certificates
+func Load(certFile, keyFile string) (*Pair, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key %s", keyFile)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pair{Cert: cert, Key: signer}, nil
+}
+
+// Write writes the PEM encoded certificate and key, the key is readable by the owner only
+func (p *Pair) Write(certFile, keyFile string) error {
+	key, err := x509.MarshalPKCS8PrivateKey(p.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, Encode(p.Cert), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+}
+
+func newTemplate(req *Request) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialBits))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.CommonName},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(req.Validity),
+	}
+
+	for _, h := range req.Hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	return tmpl, nil
+}
+
+func newClientTemplate(req *Request) (*x509.Certificate, error) {
+	if len(req.CommonName) == 0 {
+		return nil, fmt.Errorf("no common name for the client certificate")
+	}
+
+	tmpl, err := newTemplate(req)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return tmpl, nil
+}
+
+// issue generates the key and signs the certificate by the CA, the certificate is self-signed if the CA is nil
+func issue(tmpl *x509.Certificate, ca *Pair) (*Pair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, signer := tmpl, crypto.Signer(key)
+	if ca != nil {
+		parent, signer = ca.Cert, ca.Key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pair{Cert: cert, Key: key}, nil
+}
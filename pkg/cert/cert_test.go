@@ -0,0 +1,87 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA(&Request{CommonName: "test CA", Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := ca.IssueServer(&Request{CommonName: "vps", Hosts: []string{"10.0.0.1", "vps.example.com"}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := ca.IssueClient(&Request{CommonName: "home", Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	if _, err := srv.Cert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "vps.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.Cert.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("unexpected IP addresses %v", srv.Cert.IPAddresses)
+	}
+
+	if _, err := cli.Cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	if cli.Cert.Subject.CommonName != "home" {
+		t.Fatalf("unexpected common name %s", cli.Cert.Subject.CommonName)
+	}
+
+	if _, err := ca.IssueServer(&Request{CommonName: "vps", Validity: time.Hour}); err == nil {
+		t.Fatal("server certificate without hosts issued")
+	}
+	if _, err := ca.IssueClient(&Request{Validity: time.Hour}); err == nil {
+		t.Fatal("client certificate without common name issued")
+	}
+}
+
+func TestSignClient(t *testing.T) {
+	ca, err := NewCA(&Request{CommonName: "test CA", Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, csr, err := NewRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := ParseRequest(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseRequest(csr[:len(csr)-1]); err == nil {
+		t.Fatal("corrupted request accepted")
+	}
+
+	c, err := ca.SignClient(cr, &Request{CommonName: "home", Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject.CommonName != "home" || !c.PublicKey.(interface{ Equal(x crypto.PublicKey) bool }).Equal(key.Public()) {
+		t.Fatal("certificate does not match the request")
+	}
+
+	certs, err := Decode(append(Encode(ca.Cert), Encode(c)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || Fingerprint(certs[0]) != Fingerprint(ca.Cert) || Fingerprint(certs[1]) == Fingerprint(ca.Cert) {
+		t.Fatal("unexpected decoded certificates")
+	}
+	if _, err := Decode([]byte("garbage")); err == nil {
+		t.Fatal("garbage decoded")
+	}
+}
@@ -7,6 +7,13 @@ import (
 	"github.com/pkg/errors"
 )
 
+// json keeps numbers as is and produces stable output by sorting map keys
+var json = jsoniter.Config{
+	EscapeHTML:  true,
+	SortMapKeys: true,
+	UseNumber:   true,
+}.Froze()
+
 type fastJsonCodec struct{}
 
 func NewFastJsonCodec() Codec {
@@ -14,7 +21,7 @@ func NewFastJsonCodec() Codec {
 }
 
 func (_ *fastJsonCodec) Unmarshal(data []byte, v interface{}) error {
-	err := jsoniter.Unmarshal(data, v)
+	err := json.Unmarshal(data, v)
 	return errors.WithStack(err)
 }
 
@@ -22,6 +29,6 @@ func (_ *fastJsonCodec) Marshal(v interface{}) ([]byte, error) {
 	if reader, ok := v.(io.Reader); ok {
 		return io.ReadAll(reader)
 	}
-	data, err := jsoniter.Marshal(v)
+	data, err := json.Marshal(v)
 	return data, errors.WithStack(err)
 }
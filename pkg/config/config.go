@@ -20,6 +20,8 @@ import (
 
 const (
 	tagDefault = "default"
+	// EnvPath environment variable with the path of the config file
+	EnvPath = "MQTT_SYNC_CONFIG"
 )
 
 type Config struct {
@@ -29,12 +31,18 @@ type Config struct {
 	observers []func(interface{})
 }
 
+// New reads the config file set by the environment variable
 func New(cfg interface{}) (*Config, error) {
-	path, ok := os.LookupEnv("MQTT_SYNC_CONFIG")
+	path, ok := os.LookupEnv(EnvPath)
 	if !ok {
-		return nil, errors.New("MQTT_SYNC_CONFIG is not set")
+		return nil, errors.New(EnvPath + " is not set")
 	}
 
+	return Load(path, cfg)
+}
+
+// Load reads the config file and sets default values
+func Load(path string, cfg interface{}) (*Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading config file %s: %s", path, err)
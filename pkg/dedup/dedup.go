@@ -0,0 +1,106 @@
+// Package dedup skips messages whose payload has not changed since the last forwarded message of the topic
+package dedup
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+// Rule deduplicates messages of every topic matching the filter, Ignore lists top level
+// JSON object keys which are not compared
+type Rule struct {
+	Topic  string
+	Ignore []string
+}
+
+// Filter remembers the payload hash of the last forwarded message per topic
+type Filter struct {
+	codec codec.Codec
+	rules []Rule
+	last  map[string]uint64
+	sync.Mutex
+}
+
+// New creates a new Filter, the first rule matching the topic wins
+func New(rules []Rule, c codec.Codec) (*Filter, error) {
+	for _, r := range rules {
+		if err := topic.Validate(r.Topic); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Filter{
+		codec: c,
+		rules: rules,
+		last:  make(map[string]uint64),
+	}, nil
+}
+
+// Unchanged reports whether the payload is equal to the last payload of the topic,
+// otherwise the payload is remembered as the last one
+func (f *Filter) Unchanged(t string, payload []byte) bool {
+	if f == nil {
+		return false
+	}
+
+	r := f.match(t)
+	if r == nil {
+		return false
+	}
+
+	h := f.hash(r, payload)
+
+	f.Lock()
+	defer f.Unlock()
+
+	if last, ok := f.last[t]; ok && last == h {
+		return true
+	}
+	f.last[t] = h
+
+	return false
+}
+
+// Forget forgets the last payload of the topic, so the next message is not skipped
+func (f *Filter) Forget(t string) {
+	if f == nil {
+		return
+	}
+
+	f.Lock()
+	delete(f.last, t)
+	f.Unlock()
+}
+
+func (f *Filter) match(t string) *Rule {
+	for i := range f.rules {
+		if topic.Match(f.rules[i].Topic, t) {
+			return &f.rules[i]
+		}
+	}
+	return nil
+}
+
+func (f *Filter) hash(r *Rule, payload []byte) uint64 {
+	h := fnv.New64a()
+
+	if len(r.Ignore) != 0 {
+		var obj map[string]interface{}
+		if err := f.codec.Unmarshal(payload, &obj); err == nil && obj != nil {
+			for _, k := range r.Ignore {
+				delete(obj, k)
+			}
+			// the codec sorts map keys, so equal objects are encoded equally
+			if data, err := f.codec.Marshal(obj); err == nil {
+				payload = data
+			}
+		}
+	}
+
+	_, _ = h.Write(payload)
+
+	return h.Sum64()
+}
@@ -0,0 +1,76 @@
+package dedup
+
+import (
+	"testing"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+)
+
+func TestUnchanged(t *testing.T) {
+	f := newTestFilter(t, []Rule{
+		{Topic: "z2m/+", Ignore: []string{"last_seen", "linkquality"}},
+		{Topic: "raw/#"},
+	})
+
+	tests := []struct {
+		topic     string
+		payload   string
+		unchanged bool
+	}{
+		{"z2m/lamp", `{"state":"ON","last_seen":1}`, false},
+		{"z2m/lamp", `{"last_seen":2,"state":"ON","linkquality":80}`, true},
+		{"z2m/lamp", `{"state":"OFF","last_seen":3}`, false},
+		{"z2m/plug", `{"state":"OFF","last_seen":3}`, false},
+		{"z2m/lamp", `{"state":"OFF"}`, true},
+		{"z2m/lamp", `not json`, false},
+		{"z2m/lamp", `not json`, true},
+		{"raw/a", `{"state":"ON","last_seen":1}`, false},
+		{"raw/a", `{"state":"ON","last_seen":2}`, false},
+		{"raw/a", `{"state":"ON","last_seen":2}`, true},
+		{"other", `1`, false},
+		{"other", `1`, false},
+	}
+
+	for i, tt := range tests {
+		if got := f.Unchanged(tt.topic, []byte(tt.payload)); got != tt.unchanged {
+			t.Fatalf("%d: %s %s: expected %v, got %v", i, tt.topic, tt.payload, tt.unchanged, got)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	f := newTestFilter(t, []Rule{{Topic: "#"}})
+
+	if f.Unchanged("a", []byte("1")) {
+		t.Fatal("first message is skipped")
+	}
+	f.Forget("a")
+	if f.Unchanged("a", []byte("1")) {
+		t.Fatal("message is skipped after forget")
+	}
+	if !f.Unchanged("a", []byte("1")) {
+		t.Fatal("duplicate is not skipped")
+	}
+
+	var nilFilter *Filter
+	if nilFilter.Unchanged("a", []byte("1")) {
+		t.Fatal("nil filter skips messages")
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	if _, err := New([]Rule{{Topic: "a/#/b"}}, codec.NewFastJsonCodec()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func newTestFilter(t *testing.T, rules []Rule) *Filter {
+	t.Helper()
+
+	f, err := New(rules, codec.NewFastJsonCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
@@ -0,0 +1,117 @@
+// Package echo provides suppression of messages relayed back by an MQTT broker
+package echo
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Direction of the relayed message
+type Direction int
+
+const (
+	// Inbound message received from the peer and published to the local broker
+	Inbound Direction = iota
+	// Outbound message received from the local broker and sent to the peer
+	Outbound
+)
+
+const (
+	initialFilterSize = 100
+)
+
+type key struct {
+	direction Direction
+	topic     string
+	hash      uint64
+}
+
+type entry struct {
+	count   int
+	expires time.Time
+}
+
+// Filter tracks recently relayed messages and recognizes their echoes
+type Filter struct {
+	ttl     time.Duration
+	entries map[key]*entry
+	cleanAt time.Time
+	sync.Mutex
+}
+
+// New creates a new Filter, relayed messages are remembered for ttl
+func New(ttl time.Duration) *Filter {
+	return &Filter{
+		ttl:     ttl,
+		entries: make(map[key]*entry, initialFilterSize),
+		cleanAt: time.Now().Add(ttl),
+	}
+}
+
+// Add remembers the message relayed in the given direction
+func (f *Filter) Add(d Direction, topic string, payload []byte) {
+	now := time.Now()
+	k := newKey(d, topic, payload)
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.cleanup(now)
+
+	e, ok := f.entries[k]
+	if !ok || now.After(e.expires) {
+		e = &entry{}
+		f.entries[k] = e
+	}
+	e.count++
+	e.expires = now.Add(f.ttl)
+}
+
+// Echo reports whether the message is an echo of a message relayed in the given direction.
+// Each relayed message suppresses exactly one echo.
+func (f *Filter) Echo(d Direction, topic string, payload []byte) bool {
+	now := time.Now()
+	k := newKey(d, topic, payload)
+
+	f.Lock()
+	defer f.Unlock()
+
+	e, ok := f.entries[k]
+	if !ok {
+		return false
+	}
+	if now.After(e.expires) {
+		delete(f.entries, k)
+		return false
+	}
+
+	e.count--
+	if e.count == 0 {
+		delete(f.entries, k)
+	}
+
+	return true
+}
+
+func (f *Filter) cleanup(now time.Time) {
+	if now.Before(f.cleanAt) {
+		return
+	}
+	for k, e := range f.entries {
+		if now.After(e.expires) {
+			delete(f.entries, k)
+		}
+	}
+	f.cleanAt = now.Add(f.ttl)
+}
+
+func newKey(d Direction, topic string, payload []byte) key {
+	h := fnv.New64a()
+	_, _ = h.Write(payload)
+	return key{
+		direction: d,
+		topic:     topic,
+		hash:      h.Sum64(),
+	}
+}
@@ -0,0 +1,113 @@
+package echo
+
+import (
+	"testing"
+	"time"
+)
+
+type step struct {
+	add       bool
+	direction Direction
+	topic     string
+	payload   string
+	sleep     time.Duration
+	echo      bool
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		ttl   time.Duration
+		steps []step
+	}{
+		{
+			name: "echo of relayed message",
+			ttl:  time.Minute,
+			steps: []step{
+				{add: true, direction: Inbound, topic: "lamp", payload: "ON"},
+				{direction: Inbound, topic: "lamp", payload: "ON", echo: true},
+				{direction: Inbound, topic: "lamp", payload: "ON"},
+			},
+		},
+		{
+			name: "directions are separated",
+			ttl:  time.Minute,
+			steps: []step{
+				{add: true, direction: Inbound, topic: "lamp", payload: "ON"},
+				{direction: Outbound, topic: "lamp", payload: "ON"},
+				{direction: Inbound, topic: "lamp", payload: "ON", echo: true},
+			},
+		},
+		{
+			name: "topic and payload must match",
+			ttl:  time.Minute,
+			steps: []step{
+				{add: true, direction: Outbound, topic: "lamp", payload: "ON"},
+				{direction: Outbound, topic: "lamp", payload: "OFF"},
+				{direction: Outbound, topic: "plug", payload: "ON"},
+				{direction: Outbound, topic: "lamp", payload: "ON", echo: true},
+			},
+		},
+		{
+			name: "each identical relay suppresses one echo",
+			ttl:  time.Minute,
+			steps: []step{
+				{add: true, direction: Outbound, topic: "button", payload: "single"},
+				{add: true, direction: Outbound, topic: "button", payload: "single"},
+				{add: true, direction: Outbound, topic: "button", payload: "single"},
+				{direction: Outbound, topic: "button", payload: "single", echo: true},
+				{direction: Outbound, topic: "button", payload: "single", echo: true},
+				{direction: Outbound, topic: "button", payload: "single", echo: true},
+				{direction: Outbound, topic: "button", payload: "single"},
+			},
+		},
+		{
+			name: "relayed message expires",
+			ttl:  20 * time.Millisecond,
+			steps: []step{
+				{add: true, direction: Inbound, topic: "lamp", payload: "ON"},
+				{sleep: 40 * time.Millisecond, direction: Inbound, topic: "lamp", payload: "ON"},
+			},
+		},
+		{
+			name: "expired entry restarts the counter",
+			ttl:  20 * time.Millisecond,
+			steps: []step{
+				{add: true, direction: Inbound, topic: "lamp", payload: "ON"},
+				{add: true, direction: Inbound, topic: "lamp", payload: "ON"},
+				{add: true, sleep: 40 * time.Millisecond, direction: Inbound, topic: "lamp", payload: "ON"},
+				{direction: Inbound, topic: "lamp", payload: "ON", echo: true},
+				{direction: Inbound, topic: "lamp", payload: "ON"},
+			},
+		},
+		{
+			// the message could not be published, the check consumes the entry of the message
+			// so the redelivered message is relayed again and its echo is suppressed once
+			name: "publish failure",
+			ttl:  time.Minute,
+			steps: []step{
+				{add: true, direction: Inbound, topic: "lamp/set", payload: "ON"},
+				{direction: Inbound, topic: "lamp/set", payload: "ON", echo: true},
+				{add: true, direction: Inbound, topic: "lamp/set", payload: "ON"},
+				{direction: Inbound, topic: "lamp/set", payload: "ON", echo: true},
+				{direction: Inbound, topic: "lamp/set", payload: "ON"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(tt.ttl)
+			for i, s := range tt.steps {
+				time.Sleep(s.sleep)
+				if s.add {
+					f.Add(s.direction, s.topic, []byte(s.payload))
+					continue
+				}
+				if echo := f.Echo(s.direction, s.topic, []byte(s.payload)); echo != s.echo {
+					t.Fatalf("step %d: expected echo %v, got %v", i, s.echo, echo)
+				}
+			}
+		})
+	}
+}
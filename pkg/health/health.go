@@ -0,0 +1,47 @@
+// Package health provides readiness checks of the application components
+package health
+
+import (
+	"sync"
+)
+
+// Check reports whether the component is ready
+type Check func() bool
+
+type check struct {
+	name  string
+	check Check
+}
+
+// Status is a set of named readiness checks
+type Status struct {
+	checks []check
+	sync.RWMutex
+}
+
+func New() *Status {
+	return &Status{}
+}
+
+// Add adds the readiness check of the component
+func (s *Status) Add(name string, c Check) {
+	s.Lock()
+	defer s.Unlock()
+	s.checks = append(s.checks, check{name: name, check: c})
+}
+
+// Ready reports whether all components are ready and returns the state of every component
+func (s *Status) Ready() (bool, map[string]bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ready := true
+	checks := make(map[string]bool, len(s.checks))
+	for _, c := range s.checks {
+		ok := c.check()
+		checks[c.name] = ok
+		ready = ready && ok
+	}
+
+	return ready, checks
+}
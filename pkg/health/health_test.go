@@ -0,0 +1,29 @@
+package health
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestReady(t *testing.T) {
+	var mqtt, grpc atomic.Bool
+
+	s := New()
+	if ready, _ := s.Ready(); !ready {
+		t.Fatal("status without checks is not ready")
+	}
+
+	s.Add("mqtt", mqtt.Load)
+	s.Add("grpc", grpc.Load)
+
+	mqtt.Store(true)
+	ready, checks := s.Ready()
+	if ready || !checks["mqtt"] || checks["grpc"] {
+		t.Fatalf("unexpected status %v %v", ready, checks)
+	}
+
+	grpc.Store(true)
+	if ready, checks = s.Ready(); !ready {
+		t.Fatalf("unexpected status %v %v", ready, checks)
+	}
+}
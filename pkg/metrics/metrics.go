@@ -0,0 +1,219 @@
+// Package metrics provides Prometheus metrics of the bridge
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "mqtt_sync"
+
+	// DropQueuePolicy the message is not queued or superseded according to the queue policy
+	DropQueuePolicy = "queue_policy"
+	// DropQueueFull the persistent queue is full
+	DropQueueFull = "queue_full"
+	// DropOutboxFull the oldest unacknowledged message is dropped
+	DropOutboxFull = "outbox_full"
+	// DropRateLimit the message is suppressed by the rate limit
+	DropRateLimit = "rate_limit"
+	// DropUnchanged the message is skipped because the payload has not changed
+	DropUnchanged = "unchanged"
+)
+
+var (
+	registry    = prometheus.NewRegistry()
+	topicLevels atomic.Int32
+	queues      = make(map[string]prometheus.Collector)
+	queuesMu    sync.Mutex
+
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Messages forwarded over the gRPC stream by direction and topic prefix.",
+	}, []string{"direction", "topic"})
+
+	bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "payload_bytes_total",
+		Help:      "Payload bytes forwarded over the gRPC stream by direction and topic prefix.",
+	}, []string{"direction", "topic"})
+
+	latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "latency_seconds",
+		Help:      "Time from sending the message by the peer until it is handled.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"direction"})
+
+	dropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Messages which are not forwarded by reason.",
+	}, []string{"reason"})
+
+	publishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "publish_errors_total",
+		Help:      "Failed publications to the MQTT broker.",
+	})
+
+	mqttConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_connected",
+		Help:      "Whether the MQTT client is connected to the broker.",
+	})
+
+	mqttReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_reconnects_total",
+		Help:      "Connections to the MQTT broker after the first one.",
+	})
+
+	grpcPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "grpc_peers",
+		Help:      "Connected gRPC peers, for the client 1 when the stream to the server is established.",
+	})
+
+	grpcReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_reconnects_total",
+		Help:      "gRPC streams established by already known peers.",
+	})
+)
+
+func init() {
+	topicLevels.Store(1)
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		messages,
+		bytes,
+		latency,
+		dropped,
+		publishErrors,
+		mqttConnected,
+		mqttReconnects,
+		grpcPeers,
+		grpcReconnects,
+	)
+}
+
+// Handler returns the HTTP handler exposing the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// SetTopicLevels sets the number of topic levels used as the topic label, 0 disables the topic label
+func SetTopicLevels(n int) {
+	topicLevels.Store(int32(n))
+}
+
+// Forwarded counts the message forwarded in the direction
+func Forwarded(direction, topic string, size int) {
+	t := topicPrefix(topic, int(topicLevels.Load()))
+	messages.WithLabelValues(direction, t).Inc()
+	bytes.WithLabelValues(direction, t).Add(float64(size))
+}
+
+// Latency observes the time since the message was sent
+func Latency(direction string, sent time.Time) {
+	latency.WithLabelValues(direction).Observe(time.Since(sent).Seconds())
+}
+
+// Dropped counts the message which is not forwarded
+func Dropped(reason string) {
+	dropped.WithLabelValues(reason).Inc()
+}
+
+// PublishError counts the failed publication to the MQTT broker
+func PublishError() {
+	publishErrors.Inc()
+}
+
+// RegisterQueue exposes the number of messages in the queue, the previously registered queue
+// with the same name is replaced
+func RegisterQueue(name string, length func() int) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	if c, ok := queues[name]; ok {
+		registry.Unregister(c)
+	}
+
+	c := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Messages waiting in the queue.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 {
+		return float64(length())
+	})
+	registry.MustRegister(c)
+	queues[name] = c
+}
+
+// UnregisterQueue removes the queue metric
+func UnregisterQueue(name string) {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+
+	if c, ok := queues[name]; ok {
+		registry.Unregister(c)
+		delete(queues, name)
+	}
+}
+
+// SetMQTTConnected sets the MQTT connection state
+func SetMQTTConnected(connected bool) {
+	mqttConnected.Set(boolValue(connected))
+}
+
+// MQTTReconnect counts the reconnection to the MQTT broker
+func MQTTReconnect() {
+	mqttReconnects.Inc()
+}
+
+// SetGRPCPeers sets the number of connected gRPC peers
+func SetGRPCPeers(n int) {
+	grpcPeers.Set(float64(n))
+}
+
+// GRPCReconnect counts the reconnection of the gRPC peer
+func GRPCReconnect() {
+	grpcReconnects.Inc()
+}
+
+// topicPrefix returns the first levels of the topic
+func topicPrefix(topic string, levels int) string {
+	if levels <= 0 {
+		return ""
+	}
+
+	var n int
+	for i := 0; i < len(topic); i++ {
+		if topic[i] != '/' {
+			continue
+		}
+		if n++; n == levels {
+			return topic[:i]
+		}
+	}
+
+	return topic
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
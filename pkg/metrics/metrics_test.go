@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTopicPrefix(t *testing.T) {
+	tests := []struct {
+		topic  string
+		levels int
+		prefix string
+	}{
+		{"zigbee2mqtt/lamp/set", 1, "zigbee2mqtt"},
+		{"zigbee2mqtt/lamp/set", 2, "zigbee2mqtt/lamp"},
+		{"zigbee2mqtt/lamp/set", 3, "zigbee2mqtt/lamp/set"},
+		{"zigbee2mqtt/lamp/set", 5, "zigbee2mqtt/lamp/set"},
+		{"zigbee2mqtt", 1, "zigbee2mqtt"},
+		{"/lamp", 1, ""},
+		{"zigbee2mqtt/lamp", 0, ""},
+	}
+
+	for _, tt := range tests {
+		if got := topicPrefix(tt.topic, tt.levels); got != tt.prefix {
+			t.Fatalf("%s (%d): expected %q, got %q", tt.topic, tt.levels, tt.prefix, got)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	Forwarded("outbound", "zigbee2mqtt/lamp", 10)
+	Dropped(DropRateLimit)
+	RegisterQueue("client", func() int { return 2 })
+	RegisterQueue("client", func() int { return 3 })
+	defer UnregisterQueue("client")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`mqtt_sync_messages_total{direction="outbound",topic="zigbee2mqtt"} 1`,
+		`mqtt_sync_payload_bytes_total{direction="outbound",topic="zigbee2mqtt"} 10`,
+		`mqtt_sync_dropped_messages_total{reason="rate_limit"} 1`,
+		`mqtt_sync_queue_depth{queue="client"} 3`,
+	} {
+		if !strings.Contains(string(body), s) {
+			t.Fatalf("metric %s not found in:\n%s", s, body)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Package ratelimit provides per topic rate limiting, throttling and debouncing of messages
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	// ModeLimit drops messages exceeding the token bucket rate
+	ModeLimit = "limit"
+	// ModeThrottle forwards at most one message per interval, the latest suppressed message is forwarded at the end of the interval
+	ModeThrottle = "throttle"
+	// ModeDebounce forwards the latest message when no messages have been received for the interval
+	ModeDebounce = "debounce"
+)
+
+// Result of the rate limit check
+type Result int
+
+const (
+	// Allowed the message can be forwarded now
+	Allowed Result = iota
+	// Delayed the message is kept and passed to the emit function later unless a newer message replaces it
+	Delayed
+	// Suppressed the message is dropped
+	Suppressed
+)
+
+// Rule limits messages of every topic matching the filter
+type Rule struct {
+	Topic    string
+	Mode     string
+	Rate     float64
+	Burst    int
+	Interval time.Duration
+}
+
+// Stat counters of the rule
+type Stat struct {
+	Topic      string
+	Mode       string
+	Passed     uint64
+	Suppressed uint64
+}
+
+type rule struct {
+	Rule
+	passed     atomic.Uint64
+	suppressed atomic.Uint64
+}
+
+type state[T any] struct {
+	tokens  float64
+	last    time.Time
+	next    time.Time
+	pending *T
+	timer   *time.Timer
+	gen     uint64
+}
+
+// Limiter limits messages per topic, delayed messages are passed to the emit function,
+// delayed messages replaced by a newer message are passed to the drop function
+type Limiter[T any] struct {
+	rules  []*rule
+	emit   func(m T)
+	drop   func(m T)
+	states map[string]*state[T]
+	closed bool
+	sync.Mutex
+}
+
+// New creates a new Limiter, the first rule matching the topic wins
+func New[T any](rules []Rule, emit func(m T), drop func(m T)) (*Limiter[T], error) {
+	l := &Limiter[T]{
+		rules:  make([]*rule, 0, len(rules)),
+		emit:   emit,
+		drop:   drop,
+		states: make(map[string]*state[T]),
+	}
+
+	for _, r := range rules {
+		if err := topic.Validate(r.Topic); err != nil {
+			return nil, err
+		}
+		switch r.Mode {
+		case ModeLimit:
+			if r.Rate <= 0 {
+				return nil, fmt.Errorf("invalid rate %v for topic %s", r.Rate, r.Topic)
+			}
+			if r.Burst < 1 {
+				r.Burst = 1
+			}
+		case ModeThrottle, ModeDebounce:
+			if r.Interval <= 0 {
+				return nil, fmt.Errorf("invalid interval %v for topic %s", r.Interval, r.Topic)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rate limit mode %q for topic %s", r.Mode, r.Topic)
+		}
+		l.rules = append(l.rules, &rule{Rule: r})
+	}
+
+	return l, nil
+}
+
+// Allow reports whether the message can be forwarded now, is delayed and passed to the emit function later
+// or is suppressed
+func (l *Limiter[T]) Allow(t string, m T) Result {
+	r := l.match(t)
+	if r == nil {
+		return Allowed
+	}
+
+	now := time.Now()
+
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return Allowed
+	}
+
+	s, ok := l.states[t]
+	if !ok {
+		s = &state[T]{tokens: float64(r.Burst), last: now}
+		l.states[t] = s
+	}
+
+	var (
+		result   Result
+		replaced *T
+	)
+	switch r.Mode {
+	case ModeLimit:
+		result = s.take(r, now)
+	case ModeThrottle:
+		result, replaced = l.throttle(r, t, s, m, now)
+	case ModeDebounce:
+		result, replaced = l.debounce(r, t, s, m)
+	}
+	l.Unlock()
+
+	if result == Allowed {
+		r.passed.Add(1)
+	}
+	if replaced != nil && l.drop != nil {
+		l.drop(*replaced)
+	}
+
+	return result
+}
+
+// Stats returns counters of all rules
+func (l *Limiter[T]) Stats() []Stat {
+	stats := make([]Stat, 0, len(l.rules))
+	for _, r := range l.rules {
+		stats = append(stats, Stat{
+			Topic:      r.Topic,
+			Mode:       r.Mode,
+			Passed:     r.passed.Load(),
+			Suppressed: r.suppressed.Load(),
+		})
+	}
+	return stats
+}
+
+// Close stops timers, delayed messages are dropped
+func (l *Limiter[T]) Close() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.closed = true
+	for _, s := range l.states {
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+	}
+}
+
+func (l *Limiter[T]) match(t string) *rule {
+	for _, r := range l.rules {
+		if topic.Match(r.Topic, t) {
+			return r
+		}
+	}
+	return nil
+}
+
+// take takes a token from the bucket
+func (s *state[T]) take(r *rule, now time.Time) Result {
+	s.tokens = min(float64(r.Burst), s.tokens+now.Sub(s.last).Seconds()*r.Rate)
+	s.last = now
+
+	if s.tokens < 1 {
+		r.suppressed.Add(1)
+		return Suppressed
+	}
+	s.tokens--
+
+	return Allowed
+}
+
+func (l *Limiter[T]) throttle(r *rule, t string, s *state[T], m T, now time.Time) (Result, *T) {
+	if !now.Before(s.next) && s.pending == nil {
+		s.next = now.Add(r.Interval)
+		return Allowed, nil
+	}
+
+	replaced := l.delay(r, s, m)
+	if s.timer == nil {
+		gen := s.arm()
+		s.timer = time.AfterFunc(s.next.Sub(now), func() {
+			l.fire(r, t, gen, true)
+		})
+	}
+
+	return Delayed, replaced
+}
+
+func (l *Limiter[T]) debounce(r *rule, t string, s *state[T], m T) (Result, *T) {
+	replaced := l.delay(r, s, m)
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	gen := s.arm()
+	s.timer = time.AfterFunc(r.Interval, func() {
+		l.fire(r, t, gen, false)
+	})
+
+	return Delayed, replaced
+}
+
+// delay keeps the message until the timer fires, the previously kept message is suppressed and returned
+func (l *Limiter[T]) delay(r *rule, s *state[T], m T) *T {
+	replaced := s.pending
+	if replaced != nil {
+		r.suppressed.Add(1)
+	}
+	s.pending = &m
+	return replaced
+}
+
+// arm starts a new generation of the timer, a timer of an older generation which has already fired
+// and waits for the lock must not emit the message
+func (s *state[T]) arm() uint64 {
+	s.gen++
+	return s.gen
+}
+
+// fire emits the delayed message of the topic unless the timer has been re-armed
+func (l *Limiter[T]) fire(r *rule, t string, gen uint64, throttle bool) {
+	l.Lock()
+	s := l.states[t]
+	if l.closed || s == nil || s.gen != gen || s.pending == nil {
+		l.Unlock()
+		return
+	}
+	m := *s.pending
+	s.pending = nil
+	s.timer = nil
+	if throttle {
+		s.next = time.Now().Add(r.Interval)
+	}
+	l.Unlock()
+
+	r.passed.Add(1)
+	l.emit(m)
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type emitter struct {
+	messages []int
+	dropped  []int
+	sync.Mutex
+}
+
+func (e *emitter) emit(m int) {
+	e.Lock()
+	e.messages = append(e.messages, m)
+	e.Unlock()
+}
+
+func (e *emitter) drop(m int) {
+	e.Lock()
+	e.dropped = append(e.dropped, m)
+	e.Unlock()
+}
+
+func (e *emitter) get() []int {
+	e.Lock()
+	defer e.Unlock()
+	return append([]int(nil), e.messages...)
+}
+
+func (e *emitter) getDropped() []int {
+	e.Lock()
+	defer e.Unlock()
+	return append([]int(nil), e.dropped...)
+}
+
+func TestLimit(t *testing.T) {
+	e := &emitter{}
+	l := newTestLimiter(t, Rule{Topic: "plug/+", Mode: ModeLimit, Rate: 10, Burst: 2}, e)
+
+	results := make(map[Result]int)
+	for i := 0; i < 5; i++ {
+		results[l.Allow("plug/a", i)]++
+	}
+	if results[Allowed] != 2 || results[Suppressed] != 3 {
+		t.Fatalf("expected burst of 2 messages and 3 suppressed, got %v", results)
+	}
+
+	if l.Allow("plug/b", 0) != Allowed {
+		t.Fatal("topics must be limited independently")
+	}
+	if l.Allow("other", 0) != Allowed {
+		t.Fatal("topics not matching rules must not be limited")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if l.Allow("plug/a", 5) != Allowed {
+		t.Fatal("bucket is not refilled")
+	}
+
+	stat := l.Stats()[0]
+	if stat.Passed != 4 || stat.Suppressed != 3 {
+		t.Fatalf("unexpected counters %+v", stat)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	e := &emitter{}
+	l := newTestLimiter(t, Rule{Topic: "plug/#", Mode: ModeThrottle, Interval: 100 * time.Millisecond}, e)
+
+	if l.Allow("plug/a", 0) != Allowed {
+		t.Fatal("first message must be forwarded")
+	}
+	for i := 1; i < 4; i++ {
+		if l.Allow("plug/a", i) != Delayed {
+			t.Fatalf("message %d must be delayed", i)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got := e.get(); len(got) != 1 || got[0] != 3 {
+		t.Fatalf("the latest message must be forwarded at the end of interval, got %v", got)
+	}
+	if got := e.getDropped(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Fatalf("replaced messages must be dropped, got %v", got)
+	}
+
+	if l.Allow("plug/a", 4) != Delayed {
+		t.Fatal("message must be throttled after the delayed message")
+	}
+
+	stat := l.Stats()[0]
+	if stat.Passed != 2 || stat.Suppressed != 2 {
+		t.Fatalf("unexpected counters %+v", stat)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	e := &emitter{}
+	l := newTestLimiter(t, Rule{Topic: "plug/#", Mode: ModeDebounce, Interval: 50 * time.Millisecond}, e)
+
+	for i := 0; i < 5; i++ {
+		if l.Allow("plug/a", i) != Delayed {
+			t.Fatalf("message %d must be debounced", i)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := e.get(); len(got) != 0 {
+		t.Fatalf("messages forwarded before the quiet period %v", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := e.get(); len(got) != 1 || got[0] != 4 {
+		t.Fatalf("the latest message must be forwarded after the quiet period, got %v", got)
+	}
+	if got := e.getDropped(); len(got) != 4 {
+		t.Fatalf("replaced messages must be dropped, got %v", got)
+	}
+}
+
+func TestDebounceRearm(t *testing.T) {
+	e := &emitter{}
+	l := newTestLimiter(t, Rule{Topic: "plug/#", Mode: ModeDebounce, Interval: 20 * time.Millisecond}, e)
+
+	if l.Allow("plug/a", 0) != Delayed {
+		t.Fatal("message must be debounced")
+	}
+
+	// the timer fires while the limiter is locked and the message is replaced before the timer gets the lock
+	l.Lock()
+	time.Sleep(40 * time.Millisecond)
+	l.debounce(l.match("plug/a"), "plug/a", l.states["plug/a"], 1)
+	l.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	if got := e.get(); len(got) != 0 {
+		t.Fatalf("stale timer forwarded the message before the quiet period %v", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := e.get(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("the latest message must be forwarded once after the quiet period, got %v", got)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	rules := []Rule{
+		{Topic: "plug/#", Mode: ModeLimit},
+		{Topic: "plug/#", Mode: ModeThrottle},
+		{Topic: "plug/#", Mode: "burst", Interval: time.Second},
+		{Topic: "plug/#/a", Mode: ModeDebounce, Interval: time.Second},
+	}
+	for _, r := range rules {
+		if _, err := New[int]([]Rule{r}, func(int) {}, nil); err == nil {
+			t.Errorf("expected error for rule %+v", r)
+		}
+	}
+}
+
+func newTestLimiter(t *testing.T, r Rule, e *emitter) *Limiter[int] {
+	t.Helper()
+
+	l, err := New[int]([]Rule{r}, e.emit, e.drop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.Close)
+
+	return l
+}
@@ -0,0 +1,209 @@
+// Package rewrite provides MQTT topic rewriting between the local and the remote topic trees
+package rewrite
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	DirectionBoth     = "both"
+	DirectionOutbound = "outbound"
+	DirectionInbound  = "inbound"
+
+	separator   = "/"
+	singleLevel = "+"
+	multiLevel  = "#"
+)
+
+// Rule is a rewrite rule. Wildcard rules map the Local topic filter to the Remote one, wildcards
+// of the filters must be the same, the captured levels are substituted in order and the rule
+// is reversible. Regex rules replace topics matching Regex with Replace and work in one direction.
+type Rule struct {
+	Local     string
+	Remote    string
+	Regex     string
+	Replace   string
+	Direction string
+}
+
+type mapper interface {
+	rewrite(t string) (string, bool)
+}
+
+// Rewriter rewrites topics of outbound and inbound messages, the first matching rule wins
+type Rewriter struct {
+	outbound []mapper
+	inbound  []mapper
+}
+
+// New creates a new Rewriter
+func New(rules []Rule) (*Rewriter, error) {
+	r := &Rewriter{}
+
+	for _, rule := range rules {
+		direction := rule.Direction
+		if len(direction) == 0 {
+			direction = DirectionBoth
+		}
+		if direction != DirectionBoth && direction != DirectionOutbound && direction != DirectionInbound {
+			return nil, fmt.Errorf("unknown rewrite direction %q", rule.Direction)
+		}
+
+		if len(rule.Regex) != 0 {
+			if direction == DirectionBoth {
+				return nil, fmt.Errorf("regex rewrite rule %s must have a direction", rule.Regex)
+			}
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rewrite regex %s: %w", rule.Regex, err)
+			}
+			r.add(direction, &regexMapper{re: re, replace: rule.Replace})
+			continue
+		}
+
+		out, err := newWildcardMapper(rule.Local, rule.Remote)
+		if err != nil {
+			return nil, err
+		}
+		in, err := newWildcardMapper(rule.Remote, rule.Local)
+		if err != nil {
+			return nil, err
+		}
+
+		if direction != DirectionInbound {
+			r.outbound = append(r.outbound, out)
+		}
+		if direction != DirectionOutbound {
+			r.inbound = append(r.inbound, in)
+		}
+	}
+
+	return r, nil
+}
+
+// Outbound rewrites the local topic to the remote one, topics not matching any rule are not changed
+func (r *Rewriter) Outbound(t string) string {
+	return rewrite(r.outbound, t)
+}
+
+// Inbound rewrites the remote topic to the local one, topics not matching any rule are not changed
+func (r *Rewriter) Inbound(t string) string {
+	return rewrite(r.inbound, t)
+}
+
+func (r *Rewriter) add(direction string, m mapper) {
+	if direction == DirectionOutbound {
+		r.outbound = append(r.outbound, m)
+	} else {
+		r.inbound = append(r.inbound, m)
+	}
+}
+
+func rewrite(mappers []mapper, t string) string {
+	for _, m := range mappers {
+		if rewritten, ok := m.rewrite(t); ok {
+			return rewritten
+		}
+	}
+	return t
+}
+
+// wildcardMapper maps topics matching the source filter to the target filter
+type wildcardMapper struct {
+	from []string
+	to   []string
+}
+
+func newWildcardMapper(from, to string) (*wildcardMapper, error) {
+	if err := topic.Validate(from); err != nil {
+		return nil, err
+	}
+	if err := topic.Validate(to); err != nil {
+		return nil, err
+	}
+
+	m := &wildcardMapper{
+		from: strings.Split(from, separator),
+		to:   strings.Split(to, separator),
+	}
+
+	if fmt.Sprint(wildcards(m.from)) != fmt.Sprint(wildcards(m.to)) {
+		return nil, fmt.Errorf("rewrite rule %s -> %s: wildcards must be the same", from, to)
+	}
+
+	return m, nil
+}
+
+func (m *wildcardMapper) rewrite(t string) (string, bool) {
+	levels := strings.Split(t, separator)
+	captures := make([]string, 0, len(m.from))
+
+	for i, f := range m.from {
+		if f == multiLevel {
+			captures = append(captures, strings.Join(levels[min(i, len(levels)):], separator))
+			return m.build(captures), true
+		}
+		if i >= len(levels) {
+			return "", false
+		}
+		switch f {
+		case singleLevel:
+			captures = append(captures, levels[i])
+		case levels[i]:
+		default:
+			return "", false
+		}
+	}
+
+	if len(m.from) != len(levels) {
+		return "", false
+	}
+
+	return m.build(captures), true
+}
+
+func (m *wildcardMapper) build(captures []string) string {
+	levels := make([]string, 0, len(m.to))
+	for _, l := range m.to {
+		switch l {
+		case singleLevel:
+			levels = append(levels, captures[0])
+			captures = captures[1:]
+		case multiLevel:
+			// an empty multi-level capture matches the parent level, e.g. "a/#" matches "a"
+			if len(captures[0]) != 0 {
+				levels = append(levels, captures[0])
+			}
+		default:
+			levels = append(levels, l)
+		}
+	}
+	return strings.Join(levels, separator)
+}
+
+func wildcards(levels []string) []string {
+	var w []string
+	for _, l := range levels {
+		if l == singleLevel || l == multiLevel {
+			w = append(w, l)
+		}
+	}
+	return w
+}
+
+// regexMapper replaces topics matching the regular expression
+type regexMapper struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+func (m *regexMapper) rewrite(t string) (string, bool) {
+	if !m.re.MatchString(t) {
+		return "", false
+	}
+	return m.re.ReplaceAllString(t, m.replace), true
+}
@@ -0,0 +1,81 @@
+package rewrite
+
+import "testing"
+
+func TestWildcardRule(t *testing.T) {
+	r, err := New([]Rule{
+		{Local: "zigbee2mqtt/#", Remote: "house/z2m/#"},
+		{Local: "sensors/+/temperature", Remote: "house/+/temp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		local  string
+		remote string
+	}{
+		{local: "zigbee2mqtt/lamp", remote: "house/z2m/lamp"},
+		{local: "zigbee2mqtt/lamp/set", remote: "house/z2m/lamp/set"},
+		{local: "zigbee2mqtt", remote: "house/z2m"},
+		{local: "sensors/kitchen/temperature", remote: "house/kitchen/temp"},
+	}
+
+	for _, tt := range tests {
+		if got := r.Outbound(tt.local); got != tt.remote {
+			t.Errorf("Outbound(%q) = %q, want %q", tt.local, got, tt.remote)
+		}
+		if got := r.Inbound(tt.remote); got != tt.local {
+			t.Errorf("Inbound(%q) = %q, want %q", tt.remote, got, tt.local)
+		}
+	}
+
+	for _, unchanged := range []string{"home/lamp", "sensors/kitchen/humidity", "house/other"} {
+		if got := r.Outbound(unchanged); got != unchanged {
+			t.Errorf("Outbound(%q) = %q, want unchanged", unchanged, got)
+		}
+		if got := r.Inbound(unchanged); got != unchanged {
+			t.Errorf("Inbound(%q) = %q, want unchanged", unchanged, got)
+		}
+	}
+}
+
+func TestRuleDirection(t *testing.T) {
+	r, err := New([]Rule{
+		{Local: "zigbee2mqtt/#", Remote: "z2m/#", Direction: DirectionOutbound},
+		{Regex: `^cmd/(\w+)$`, Replace: "zigbee2mqtt/$1/set", Direction: DirectionInbound},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.Outbound("zigbee2mqtt/lamp"); got != "z2m/lamp" {
+		t.Errorf("unexpected outbound topic %q", got)
+	}
+	if got := r.Inbound("z2m/lamp"); got != "z2m/lamp" {
+		t.Errorf("outbound rule is applied to inbound topic %q", got)
+	}
+	if got := r.Inbound("cmd/lamp"); got != "zigbee2mqtt/lamp/set" {
+		t.Errorf("unexpected inbound topic %q", got)
+	}
+	if got := r.Outbound("cmd/lamp"); got != "cmd/lamp" {
+		t.Errorf("inbound rule is applied to outbound topic %q", got)
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	rules := []Rule{
+		{Local: "zigbee2mqtt/#", Remote: "house/+"},
+		{Local: "zigbee2mqtt/+/#", Remote: "house/#/+"},
+		{Local: "zigbee2mqtt/#/set", Remote: "house/#/set"},
+		{Regex: "^cmd/(.+)$", Replace: "$1"},
+		{Regex: "^cmd/(.+$", Replace: "$1", Direction: DirectionInbound},
+		{Local: "a/#", Remote: "b/#", Direction: "up"},
+	}
+
+	for _, rule := range rules {
+		if _, err := New([]Rule{rule}); err == nil {
+			t.Errorf("expected error for rule %+v", rule)
+		}
+	}
+}
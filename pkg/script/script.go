@@ -0,0 +1,247 @@
+// Package script provides Lua scripts handling bridged messages
+package script
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+)
+
+const (
+	handlerName = "handle"
+	emitName    = "emit"
+	jsonName    = "json"
+	maxQoS      = 2
+	maxDepth    = 100
+)
+
+var (
+	ErrNoHandler     = errors.New("script does not define the handle function")
+	ErrInvalidResult = errors.New("invalid script result")
+	ErrInvalidValue  = errors.New("value can not be encoded")
+)
+
+// Message is a message passed to the script
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// Meta is the message metadata passed to the script
+type Meta struct {
+	Direction      string
+	Peer           string
+	UserProperties map[string]string
+}
+
+// Script runs the handle function of a Lua script for every message. The function receives the message table
+// (topic, payload, qos, retained, direction, peer, user_properties) and returns the message table to forward it,
+// true to forward it unchanged or nil/false to drop it. emit(message) forwards an additional message.
+// Only base, table, string and math libraries and json.encode/json.decode are available.
+type Script struct {
+	name    string
+	source  string
+	timeout time.Duration
+	codec   codec.Codec
+	state   *lua.LState
+	handler *lua.LFunction
+	emitted []*Message
+	sync.Mutex
+}
+
+// Load loads the script from the file
+func Load(path string, timeout time.Duration, c codec.Codec) (*Script, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(filepath.Base(path), string(source), timeout, c)
+}
+
+// New creates a new Script, every call of the handle function is interrupted after the timeout,
+// the timeout is checked between Lua instructions, so a long call of a Go builtin such as string.rep
+// is not interrupted
+func New(name, source string, timeout time.Duration, c codec.Codec) (*Script, error) {
+	s := &Script{
+		name:    name,
+		source:  source,
+		timeout: timeout,
+		codec:   c,
+	}
+
+	if err := s.init(); err != nil {
+		return nil, fmt.Errorf("script %s: %w", name, err)
+	}
+
+	return s, nil
+}
+
+// Name returns the script name
+func (s *Script) Name() string {
+	return s.name
+}
+
+// Run calls the handle function and returns the messages to forward, the forwarded message goes first
+// followed by emitted messages. The script state is recreated after an error.
+func (s *Script) Run(m *Message, meta *Meta) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.state == nil {
+		if err := s.init(); err != nil {
+			return nil, fmt.Errorf("script %s: %w", s.name, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	s.state.SetContext(ctx)
+	s.emitted = nil
+
+	result, err := s.call(m, meta)
+	if err != nil {
+		s.state.Close()
+		s.state = nil
+		return nil, fmt.Errorf("script %s: %w", s.name, err)
+	}
+	s.state.RemoveContext()
+
+	return append(result, s.emitted...), nil
+}
+
+// Close closes the script
+func (s *Script) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.state != nil {
+		s.state.Close()
+		s.state = nil
+	}
+}
+
+func (s *Script) init() error {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+
+	for _, lib := range []struct {
+		name string
+		f    lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.f))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.SetGlobal(emitName, L.NewFunction(s.emit))
+	L.SetGlobal(jsonName, L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"encode": s.jsonEncode,
+		"decode": s.jsonDecode,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	if err := L.DoString(s.source); err != nil {
+		L.Close()
+		return err
+	}
+	L.RemoveContext()
+
+	handler, ok := L.GetGlobal(handlerName).(*lua.LFunction)
+	if !ok {
+		L.Close()
+		return ErrNoHandler
+	}
+
+	s.state = L
+	s.handler = handler
+
+	return nil
+}
+
+func (s *Script) call(m *Message, meta *Meta) ([]*Message, error) {
+	L := s.state
+
+	if err := L.CallByParam(lua.P{Fn: s.handler, NRet: 1, Protect: true}, newTable(L, m, meta)); err != nil {
+		return nil, err
+	}
+
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	switch v := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		if v {
+			return []*Message{m}, nil
+		}
+		return nil, nil
+	case *lua.LTable:
+		forwarded, err := fromTable(v)
+		if err != nil {
+			return nil, err
+		}
+		return []*Message{forwarded}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrInvalidResult, ret.Type())
+}
+
+func (s *Script) emit(L *lua.LState) int {
+	m, err := fromTable(L.CheckTable(1))
+	if err != nil {
+		L.RaiseError("emit: %v", err)
+		return 0
+	}
+	s.emitted = append(s.emitted, m)
+	return 0
+}
+
+func (s *Script) jsonEncode(L *lua.LState) int {
+	v, err := fromValue(L.CheckAny(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(data))
+	return 1
+}
+
+func (s *Script) jsonDecode(L *lua.LState) int {
+	var v interface{}
+	if err := s.codec.Unmarshal([]byte(L.CheckString(1)), &v); err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(toValue(L, v))
+	return 1
+}
@@ -0,0 +1,165 @@
+package script
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+)
+
+const testScript = `
+function handle(m)
+  if m.topic == "zigbee2mqtt/bridge/logging" then
+    return nil
+  end
+  if m.topic == "zigbee2mqtt/loop" then
+    while true do end
+  end
+  if m.topic == "zigbee2mqtt/error" then
+    error("broken device")
+  end
+  if m.topic == "zigbee2mqtt/unchanged" then
+    return true
+  end
+
+  local data = json.decode(m.payload)
+  if data.temperature ~= nil then
+    emit({topic = m.topic .. "/temperature", payload = tostring(data.temperature), retained = true})
+    data.temperature = nil
+  end
+  data.direction = m.direction
+  m.payload = json.encode(data)
+  m.qos = 1
+  return m
+end
+`
+
+func TestScript(t *testing.T) {
+	s := newTestScript(t, testScript)
+
+	out, err := s.Run(&Message{Topic: "zigbee2mqtt/sensor", Payload: []byte(`{"temperature":21.5,"humidity":40}`)}, &Meta{Direction: "outbound"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("unexpected messages %+v", out)
+	}
+	if out[0].Topic != "zigbee2mqtt/sensor" || string(out[0].Payload) != `{"direction":"outbound","humidity":40}` || out[0].QoS != 1 {
+		t.Fatalf("unexpected forwarded message %+v %s", out[0], out[0].Payload)
+	}
+	if out[1].Topic != "zigbee2mqtt/sensor/temperature" || string(out[1].Payload) != "21.5" || !out[1].Retained {
+		t.Fatalf("unexpected emitted message %+v %s", out[1], out[1].Payload)
+	}
+
+	out, err = s.Run(&Message{Topic: "zigbee2mqtt/bridge/logging", Payload: []byte("log")}, nil)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("message is not dropped: %+v %v", out, err)
+	}
+
+	m := &Message{Topic: "zigbee2mqtt/unchanged", Payload: []byte{0x00, 0xff}, QoS: 2}
+	out, err = s.Run(m, nil)
+	if err != nil || len(out) != 1 || out[0] != m {
+		t.Fatalf("message is changed: %+v %v", out, err)
+	}
+}
+
+func TestScriptIsolation(t *testing.T) {
+	s := newTestScript(t, testScript)
+
+	start := time.Now()
+	if _, err := s.Run(&Message{Topic: "zigbee2mqtt/loop"}, nil); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("script is not interrupted")
+	}
+
+	if _, err := s.Run(&Message{Topic: "zigbee2mqtt/error"}, nil); err == nil || !strings.Contains(err.Error(), "broken device") {
+		t.Fatalf("expected script error, got %v", err)
+	}
+
+	out, err := s.Run(&Message{Topic: "zigbee2mqtt/unchanged"}, nil)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("script does not work after errors: %+v %v", out, err)
+	}
+}
+
+func TestScriptInvalid(t *testing.T) {
+	c := codec.NewFastJsonCodec()
+
+	scripts := map[string]string{
+		"no handler":     `x = 1`,
+		"syntax error":   `function handle(m`,
+		"infinite loop":  `while true do end`,
+		"os is disabled": `os.exit(1)`,
+	}
+	for name, source := range scripts {
+		if _, err := New(name, source, 50*time.Millisecond, c); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	s := newTestScript(t, `function handle(m) return {payload = "no topic"} end`)
+	if _, err := s.Run(&Message{Topic: "a"}, nil); err == nil {
+		t.Fatal("expected error for message without topic")
+	}
+}
+
+func TestScriptCyclicTable(t *testing.T) {
+	s := newTestScript(t, `
+function handle(m)
+  local t = {}
+  if m.topic == "cycle" then
+    t.self = t
+  elseif m.topic == "deep" then
+    local c = t
+    for i = 1, 200 do
+      c.next = {}
+      c = c.next
+    end
+  elseif m.topic == "shared" then
+    local v = {1, 2}
+    t.a = v
+    t.b = v
+  else
+    m.self = m
+    return m
+  end
+  local data, err = json.encode(t)
+  if data == nil then
+    error(err)
+  end
+  m.payload = data
+  return m
+end
+`)
+
+	for _, topic := range []string{"cycle", "deep"} {
+		if _, err := s.Run(&Message{Topic: topic}, nil); err == nil || !strings.Contains(err.Error(), ErrInvalidValue.Error()) {
+			t.Fatalf("%s: expected encoding error, got %v", topic, err)
+		}
+	}
+
+	out, err := s.Run(&Message{Topic: "shared"}, nil)
+	if err != nil || len(out) != 1 || string(out[0].Payload) != `{"a":[1,2],"b":[1,2]}` {
+		t.Fatalf("unexpected result %+v %v", out, err)
+	}
+
+	out, err = s.Run(&Message{Topic: "returned", Payload: []byte("ON")}, nil)
+	if err != nil || len(out) != 1 || out[0].Topic != "returned" || string(out[0].Payload) != "ON" {
+		t.Fatalf("unexpected result %+v %v", out, err)
+	}
+}
+
+func newTestScript(t *testing.T, source string) *Script {
+	t.Helper()
+
+	s, err := New("test.lua", source, 50*time.Millisecond, codec.NewFastJsonCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	return s
+}
@@ -0,0 +1,157 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newTable converts the message and its metadata to a Lua table
+func newTable(L *lua.LState, m *Message, meta *Meta) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("topic", lua.LString(m.Topic))
+	t.RawSetString("payload", lua.LString(m.Payload))
+	t.RawSetString("qos", lua.LNumber(m.QoS))
+	t.RawSetString("retained", lua.LBool(m.Retained))
+
+	if meta != nil {
+		t.RawSetString("direction", lua.LString(meta.Direction))
+		t.RawSetString("peer", lua.LString(meta.Peer))
+		props := L.NewTable()
+		for k, v := range meta.UserProperties {
+			props.RawSetString(k, lua.LString(v))
+		}
+		t.RawSetString("user_properties", props)
+	}
+
+	return t
+}
+
+// fromTable converts the Lua table to a message
+func fromTable(t *lua.LTable) (*Message, error) {
+	topic, ok := t.RawGetString("topic").(lua.LString)
+	if !ok || len(topic) == 0 {
+		return nil, fmt.Errorf("%w: topic is not set", ErrInvalidResult)
+	}
+
+	m := &Message{Topic: string(topic)}
+
+	switch payload := t.RawGetString("payload").(type) {
+	case lua.LString:
+		m.Payload = []byte(payload)
+	case *lua.LNilType:
+	default:
+		return nil, fmt.Errorf("%w: payload must be a string", ErrInvalidResult)
+	}
+
+	switch qos := t.RawGetString("qos").(type) {
+	case lua.LNumber:
+		if qos < 0 || qos > maxQoS {
+			return nil, fmt.Errorf("%w: invalid qos %v", ErrInvalidResult, qos)
+		}
+		m.QoS = byte(qos)
+	case *lua.LNilType:
+	default:
+		return nil, fmt.Errorf("%w: qos must be a number", ErrInvalidResult)
+	}
+
+	m.Retained = lua.LVAsBool(t.RawGetString("retained"))
+
+	return m, nil
+}
+
+// toValue converts the decoded JSON value to a Lua value
+func toValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case fmt.Stringer:
+		// json.Number
+		n, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return lua.LString(v.String())
+		}
+		return lua.LNumber(n)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(toValue(L, e))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			t.RawSetString(k, toValue(L, e))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromValue converts the Lua value to a value encodable to JSON, tables with
+// consecutive integer keys starting from 1 become arrays,
+// tables referencing themselves and tables nested deeper than maxDepth are rejected
+func fromValue(v lua.LValue) (interface{}, error) {
+	return convertValue(v, make(map[*lua.LTable]struct{}), 0)
+}
+
+func convertValue(v lua.LValue, visited map[*lua.LTable]struct{}, depth int) (interface{}, error) {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case *lua.LTable:
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("%w: nesting deeper than %d", ErrInvalidValue, maxDepth)
+		}
+		if _, ok := visited[v]; ok {
+			return nil, fmt.Errorf("%w: table references itself", ErrInvalidValue)
+		}
+		visited[v] = struct{}{}
+		defer delete(visited, v)
+
+		if n := v.MaxN(); n > 0 && n == v.Len() && countKeys(v) == n {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				e, err := convertValue(v.RawGetInt(i), visited, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, e)
+			}
+			return arr, nil
+		}
+
+		obj := make(map[string]interface{})
+		var err error
+		v.ForEach(func(k, e lua.LValue) {
+			if err != nil {
+				return
+			}
+			obj[k.String()], err = convertValue(e, visited, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return obj, nil
+	}
+	return nil, nil
+}
+
+func countKeys(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(_, _ lua.LValue) {
+		n++
+	})
+	return n
+}
@@ -0,0 +1,488 @@
+// Package seglog provides an append-only log split into segment files
+package seglog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentExt    = ".log"
+	headFileName  = "head"
+	headerSize    = 16
+	maxRecordSize = 64 << 20
+	filePerm      = 0640
+	dirPerm       = 0750
+)
+
+var (
+	ErrFull      = errors.New("log is full")
+	ErrCorrupted = errors.New("log record is corrupted")
+	ErrClosed    = errors.New("log is closed")
+)
+
+// DropPolicy defines which records are dropped when the log is full
+type DropPolicy string
+
+const (
+	// DropOldest removes the oldest segments to free space for new records
+	DropOldest DropPolicy = "oldest"
+	// DropNewest rejects new records
+	DropNewest DropPolicy = "newest"
+)
+
+// Options log settings
+type Options struct {
+	SegmentSize int64
+	MaxSize     int64
+	MaxAge      time.Duration
+	DropPolicy  DropPolicy
+}
+
+// Record is a log record
+type Record struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte
+}
+
+type segment struct {
+	base   uint64
+	count  uint64
+	size   int64
+	newest time.Time
+	path   string
+}
+
+// Log is an append-only log, records are identified by sequence numbers
+type Log struct {
+	dir      string
+	opts     Options
+	segments []*segment
+	active   *os.File
+	head     uint64
+	next     uint64
+	size     int64
+	closed   bool
+	sync.Mutex
+}
+
+// Open opens the log in the directory, the directory is created if it does not exist
+func Open(dir string, opts Options) (*Log, error) {
+	if opts.DropPolicy != DropOldest && opts.DropPolicy != DropNewest {
+		return nil, fmt.Errorf("unknown drop policy: %s", opts.DropPolicy)
+	}
+
+	if err := os.MkdirAll(dir, dirPerm); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:  dir,
+		opts: opts,
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Append appends the record to the log and returns its sequence number
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	now := time.Now()
+	recSize := int64(headerSize + len(data))
+
+	l.dropExpired(now)
+
+	if l.opts.MaxSize > 0 && l.size+recSize > l.opts.MaxSize {
+		if l.opts.DropPolicy == DropNewest || recSize > l.opts.MaxSize {
+			return 0, ErrFull
+		}
+		if err := l.dropOldest(recSize); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := writeRecord(l.active, now, data); err != nil {
+		return 0, err
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	seg.count++
+	seg.size += recSize
+	seg.newest = now
+	l.size += recSize
+
+	seq := l.next
+	l.next++
+
+	if l.opts.SegmentSize > 0 && seg.size >= l.opts.SegmentSize {
+		if err := l.roll(); err != nil {
+			return seq, err
+		}
+	}
+
+	return seq, nil
+}
+
+// Read calls f for every record starting from the log head, records older than MaxAge are skipped.
+// Reading stops when f returns an error, the error is returned.
+func (l *Log) Read(f func(r *Record) error) error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return ErrClosed
+	}
+	now := time.Now()
+	l.dropExpired(now)
+	head := l.head
+	segments := make([]segment, 0, len(l.segments))
+	for _, s := range l.segments {
+		segments = append(segments, *s)
+	}
+	l.Unlock()
+
+	for i := range segments {
+		if segments[i].base+segments[i].count <= head {
+			continue
+		}
+		if err := l.readSegment(&segments[i], head, now, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Truncate removes records with sequence numbers less than seq
+func (l *Log) Truncate(seq uint64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	if seq <= l.head {
+		return nil
+	}
+	if seq > l.next {
+		seq = l.next
+	}
+	l.head = seq
+
+	for len(l.segments) > 1 && l.segments[0].base+l.segments[0].count <= l.head {
+		if err := l.removeFirst(); err != nil {
+			return err
+		}
+	}
+
+	if l.head == l.next {
+		if err := l.reset(); err != nil {
+			return err
+		}
+	}
+
+	return l.saveHead()
+}
+
+// Len returns the number of records in the log
+func (l *Log) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return int(l.next - l.head)
+}
+
+// Close closes the log
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if err := l.saveHead(); err != nil {
+		return err
+	}
+
+	return l.active.Close()
+}
+
+func (l *Log) load() error {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{
+			base: base,
+			path: filepath.Join(l.dir, e.Name()),
+		})
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].base < l.segments[j].base
+	})
+
+	for i, s := range l.segments {
+		if err := scanSegment(s, i == len(l.segments)-1); err != nil {
+			return err
+		}
+		l.size += s.size
+	}
+
+	if err := l.loadHead(); err != nil {
+		return err
+	}
+
+	if len(l.segments) == 0 {
+		l.next = l.head
+		return l.createSegment(l.next)
+	}
+
+	last := l.segments[len(l.segments)-1]
+	l.next = last.base + last.count
+	if l.head < l.segments[0].base {
+		l.head = l.segments[0].base
+	}
+	if l.head > l.next {
+		l.head = l.next
+	}
+
+	l.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, filePerm)
+	return err
+}
+
+func (l *Log) loadHead() error {
+	data, err := os.ReadFile(filepath.Join(l.dir, headFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return ErrCorrupted
+	}
+	l.head = binary.BigEndian.Uint64(data)
+	return nil
+}
+
+func (l *Log) saveHead() error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], l.head)
+
+	path := filepath.Join(l.dir, headFileName)
+	if err := os.WriteFile(path+".tmp", buf[:], filePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (l *Log) createSegment(base uint64) error {
+	s := &segment{
+		base: base,
+		path: filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentExt)),
+	}
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, filePerm)
+	if err != nil {
+		return err
+	}
+
+	l.active = f
+	l.segments = append(l.segments, s)
+
+	return nil
+}
+
+func (l *Log) roll() error {
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	return l.createSegment(l.next)
+}
+
+// reset removes all segments when every record has been consumed
+func (l *Log) reset() error {
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	for _, s := range l.segments {
+		if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	l.segments = l.segments[:0]
+	l.size = 0
+	return l.createSegment(l.next)
+}
+
+func (l *Log) removeFirst() error {
+	s := l.segments[0]
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l.segments = l.segments[1:]
+	l.size -= s.size
+	if l.head < l.segments[0].base {
+		l.head = l.segments[0].base
+	}
+	return nil
+}
+
+// dropOldest removes the oldest segments until the record fits
+func (l *Log) dropOldest(recSize int64) error {
+	for l.size+recSize > l.opts.MaxSize {
+		if len(l.segments) == 1 {
+			if l.segments[0].count == 0 {
+				return nil
+			}
+			if err := l.roll(); err != nil {
+				return err
+			}
+		}
+		if err := l.removeFirst(); err != nil {
+			return err
+		}
+	}
+	return l.saveHead()
+}
+
+// dropExpired removes the oldest segments containing only records older than MaxAge
+func (l *Log) dropExpired(now time.Time) {
+	if l.opts.MaxAge <= 0 {
+		return
+	}
+	for len(l.segments) > 1 && now.Sub(l.segments[0].newest) > l.opts.MaxAge {
+		if err := l.removeFirst(); err != nil {
+			return
+		}
+	}
+}
+
+func (l *Log) readSegment(s *segment, head uint64, now time.Time, f func(r *Record) error) error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(io.LimitReader(file, s.size))
+	for seq := s.base; seq < s.base+s.count; seq++ {
+		rec, _, err := readRecord(r)
+		if err != nil {
+			return err
+		}
+		if seq < head {
+			continue
+		}
+		if l.opts.MaxAge > 0 && now.Sub(rec.Time) > l.opts.MaxAge {
+			continue
+		}
+		rec.Seq = seq
+		if err := f(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanSegment counts records of the segment, the partially written tail of the last segment is truncated
+func scanSegment(s *segment, last bool) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last {
+				return nil
+			}
+			return os.Truncate(s.path, s.size)
+		}
+		s.count++
+		s.size += n
+		s.newest = rec.Time
+	}
+}
+
+func writeRecord(w io.Writer, ts time.Time, data []byte) error {
+	buf := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(ts.UnixNano()))
+	copy(buf[headerSize:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:]))
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readRecord(r io.Reader) (*Record, int64, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrCorrupted
+		}
+		return nil, 0, err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxRecordSize {
+		return nil, 0, ErrCorrupted
+	}
+	buf := make([]byte, 8+int(size))
+	copy(buf, header[8:16])
+	if _, err := io.ReadFull(r, buf[8:]); err != nil {
+		return nil, 0, ErrCorrupted
+	}
+	if crc32.ChecksumIEEE(buf) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, ErrCorrupted
+	}
+
+	return &Record{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(buf[0:8]))),
+		Data: buf[8:],
+	}, int64(headerSize) + int64(size), nil
+}
@@ -0,0 +1,203 @@
+package seglog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAppendReadTruncate(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{SegmentSize: 64, DropPolicy: DropOldest})
+
+	for i := 0; i < 10; i++ {
+		appendRecord(t, l, i)
+	}
+
+	if got := readAll(t, l); !slices.Equal(got, seq(0, 10)) {
+		t.Fatalf("unexpected records %v", got)
+	}
+
+	if err := l.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, l); !slices.Equal(got, seq(4, 10)) {
+		t.Fatalf("unexpected records after truncate %v", got)
+	}
+	if l.Len() != 6 {
+		t.Fatalf("unexpected length %d", l.Len())
+	}
+
+	if err := l.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 0 {
+		t.Fatalf("unexpected length %d", l.Len())
+	}
+	if got := readAll(t, l); len(got) != 0 {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	l := openTestLog(t, dir, Options{SegmentSize: 64, DropPolicy: DropOldest})
+	for i := 0; i < 10; i++ {
+		appendRecord(t, l, i)
+	}
+	if err := l.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, dir, Options{SegmentSize: 64, DropPolicy: DropOldest})
+	appendRecord(t, l, 10)
+
+	if got := readAll(t, l); !slices.Equal(got, seq(3, 11)) {
+		t.Fatalf("unexpected records after reopen %v", got)
+	}
+}
+
+func TestTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+
+	l := openTestLog(t, dir, Options{DropPolicy: DropOldest})
+	for i := 0; i < 3; i++ {
+		appendRecord(t, l, i)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d%s", 0, segmentExt))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openTestLog(t, dir, Options{DropPolicy: DropOldest})
+	appendRecord(t, l, 3)
+
+	if got := readAll(t, l); !slices.Equal(got, []string{"record-0", "record-1", "record-3"}) {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{SegmentSize: 48, MaxSize: 120, DropPolicy: DropOldest})
+
+	for i := 0; i < 10; i++ {
+		appendRecord(t, l, i)
+	}
+
+	got := readAll(t, l)
+	if len(got) == 0 || got[len(got)-1] != "record-9" {
+		t.Fatalf("newest record is lost %v", got)
+	}
+	if got[0] == "record-0" {
+		t.Fatalf("oldest record is not dropped %v", got)
+	}
+}
+
+func TestDropNewest(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{MaxSize: 72, DropPolicy: DropNewest})
+
+	for i := 0; i < 3; i++ {
+		appendRecord(t, l, i)
+	}
+	if _, err := l.Append([]byte("record-3")); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull, got %v", err)
+	}
+
+	if got := readAll(t, l); !slices.Equal(got, seq(0, 3)) {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{MaxAge: 50 * time.Millisecond, DropPolicy: DropOldest})
+
+	appendRecord(t, l, 0)
+	time.Sleep(100 * time.Millisecond)
+	appendRecord(t, l, 1)
+
+	if got := readAll(t, l); !slices.Equal(got, []string{"record-1"}) {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
+
+func TestReadStopsOnError(t *testing.T) {
+	l := openTestLog(t, t.TempDir(), Options{DropPolicy: DropOldest})
+	for i := 0; i < 5; i++ {
+		appendRecord(t, l, i)
+	}
+
+	errStop := errors.New("stop")
+	var read []uint64
+	err := l.Read(func(r *Record) error {
+		if r.Seq == 2 {
+			return errStop
+		}
+		read = append(read, r.Seq)
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected stop error, got %v", err)
+	}
+	if len(read) != 2 || read[0] != 0 || read[1] != 1 {
+		t.Fatalf("unexpected records %v", read)
+	}
+}
+
+func openTestLog(t *testing.T, dir string, opts Options) *Log {
+	t.Helper()
+
+	l, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	return l
+}
+
+func appendRecord(t *testing.T, l *Log, i int) {
+	t.Helper()
+
+	if _, err := l.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readAll(t *testing.T, l *Log) []string {
+	t.Helper()
+
+	var records []string
+	if err := l.Read(func(r *Record) error {
+		records = append(records, string(r.Data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return records
+}
+
+func seq(from, to int) []string {
+	records := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		records = append(records, fmt.Sprintf("record-%d", i))
+	}
+	return records
+}
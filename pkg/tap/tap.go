@@ -0,0 +1,149 @@
+// Package tap provides a live feed of messages passing through the sync use case
+package tap
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+const (
+	// ReasonEcho the message is the echo of a synchronized message
+	ReasonEcho = "echo"
+	// ReasonTopicRule the topic is rejected by the inbound or outbound rules
+	ReasonTopicRule = "topic_rule"
+	// ReasonTransform the payload cannot be transformed
+	ReasonTransform = "transform"
+	// ReasonScript the message is dropped by a script
+	ReasonScript = "script"
+	// ReasonUnchanged the payload has not changed
+	ReasonUnchanged = "unchanged"
+	// ReasonRateLimit the message is suppressed or delayed by the rate limit
+	ReasonRateLimit = "rate_limit"
+	// ReasonPublishError the message cannot be published to the broker
+	ReasonPublishError = "publish_error"
+)
+
+// Event message seen by the sync use case, Reason is set for dropped messages
+type Event struct {
+	Time      time.Time
+	Direction string
+	Peer      string
+	Topic     string
+	Payload   []byte
+	QoS       byte
+	Retained  bool
+	Dropped   bool
+	Reason    string
+}
+
+// Filter selects events, empty fields match all events
+type Filter struct {
+	Topics    []string
+	Direction string
+	Peer      string
+	Dropped   bool
+}
+
+// Subscriber receives events matching the filter, events are lost when the subscriber is too slow
+type Subscriber struct {
+	C      <-chan *Event
+	c      chan *Event
+	filter Filter
+	lost   atomic.Uint64
+}
+
+// Hub delivers events to subscribers
+type Hub struct {
+	subs   map[*Subscriber]struct{}
+	active atomic.Bool
+	sync.RWMutex
+}
+
+// New creates a new Hub
+func New() *Hub {
+	return &Hub{
+		subs: make(map[*Subscriber]struct{}),
+	}
+}
+
+// Active reports whether there are subscribers, so events are not built when nobody listens
+func (h *Hub) Active() bool {
+	return h != nil && h.active.Load()
+}
+
+// Subscribe creates a subscriber with the buffer of the size
+func (h *Hub) Subscribe(f Filter, size int) (*Subscriber, error) {
+	for _, t := range f.Topics {
+		if err := topic.Validate(t); err != nil {
+			return nil, err
+		}
+	}
+
+	c := make(chan *Event, size)
+	s := &Subscriber{C: c, c: c, filter: f}
+
+	h.Lock()
+	h.subs[s] = struct{}{}
+	h.active.Store(true)
+	h.Unlock()
+
+	return s, nil
+}
+
+// Unsubscribe removes the subscriber
+func (h *Hub) Unsubscribe(s *Subscriber) {
+	h.Lock()
+	delete(h.subs, s)
+	h.active.Store(len(h.subs) != 0)
+	h.Unlock()
+}
+
+// Publish passes the event to matching subscribers without blocking
+func (h *Hub) Publish(e *Event) {
+	if !h.Active() {
+		return
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	for s := range h.subs {
+		if !s.filter.match(e) {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			s.lost.Add(1)
+		}
+	}
+}
+
+// Lost returns the number of events lost by the subscriber
+func (s *Subscriber) Lost() uint64 {
+	return s.lost.Load()
+}
+
+func (f *Filter) match(e *Event) bool {
+	if len(f.Direction) != 0 && f.Direction != e.Direction {
+		return false
+	}
+	if len(f.Peer) != 0 && f.Peer != e.Peer {
+		return false
+	}
+	if f.Dropped && !e.Dropped {
+		return false
+	}
+	if len(f.Topics) == 0 {
+		return true
+	}
+	for _, t := range f.Topics {
+		if topic.Match(t, e.Topic) {
+			return true
+		}
+	}
+	return false
+}
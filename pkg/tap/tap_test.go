@@ -0,0 +1,59 @@
+package tap
+
+import (
+	"testing"
+)
+
+func TestHubFilter(t *testing.T) {
+	h := New()
+	if h.Active() {
+		t.Fatal("hub without subscribers is active")
+	}
+
+	if _, err := h.Subscribe(Filter{Topics: []string{"home/#/light"}}, 1); err == nil {
+		t.Fatal("invalid topic filter accepted")
+	}
+
+	s, err := h.Subscribe(Filter{Topics: []string{"home/#"}, Direction: "inbound", Dropped: true}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Active() {
+		t.Fatal("hub with a subscriber is not active")
+	}
+
+	events := []*Event{
+		{Direction: "inbound", Topic: "home/light", Dropped: true, Reason: ReasonEcho},
+		{Direction: "inbound", Topic: "home/light"},
+		{Direction: "outbound", Topic: "home/light", Dropped: true},
+		{Direction: "inbound", Topic: "office/light", Dropped: true},
+	}
+	for _, e := range events {
+		h.Publish(e)
+	}
+
+	if len(s.C) != 1 || <-s.C != events[0] {
+		t.Fatal("unexpected events")
+	}
+
+	h.Unsubscribe(s)
+	if h.Active() {
+		t.Fatal("hub is active after unsubscribe")
+	}
+}
+
+func TestHubLost(t *testing.T) {
+	h := New()
+	s, err := h.Subscribe(Filter{Peer: "home"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		h.Publish(&Event{Peer: "home", Topic: "light"})
+	}
+
+	if len(s.C) != 1 || s.Lost() != 2 {
+		t.Fatalf("expected 1 event and 2 lost, got %d and %d", len(s.C), s.Lost())
+	}
+}
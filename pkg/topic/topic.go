@@ -0,0 +1,100 @@
+// Package topic provides MQTT topic filter matching
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	separator    = "/"
+	singleLevel  = "+"
+	multiLevel   = "#"
+	systemPrefix = '$'
+)
+
+// Match reports whether the topic matches the MQTT topic filter
+func Match(filter, topic string) bool {
+	if len(topic) > 0 && topic[0] == systemPrefix && len(filter) > 0 && (filter[:1] == singleLevel || filter[:1] == multiLevel) {
+		return false
+	}
+
+	fl := strings.Split(filter, separator)
+	tl := strings.Split(topic, separator)
+
+	for i, f := range fl {
+		if f == multiLevel {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != singleLevel && f != tl[i] {
+			return false
+		}
+	}
+
+	return len(fl) == len(tl)
+}
+
+// MatchAny reports whether the topic matches any of the MQTT topic filters
+func MatchAny(filters []string, topic string) bool {
+	for _, f := range filters {
+		if Match(f, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the MQTT topic filter syntax
+func Validate(filter string) error {
+	if len(filter) == 0 {
+		return errors.New("empty topic filter")
+	}
+
+	levels := strings.Split(filter, separator)
+	for i, l := range levels {
+		switch {
+		case l == multiLevel && i != len(levels)-1:
+			return fmt.Errorf("invalid topic filter %s: %s must be the last level", filter, multiLevel)
+		case l != multiLevel && strings.Contains(l, multiLevel), l != singleLevel && strings.Contains(l, singleLevel):
+			return fmt.Errorf("invalid topic filter %s: wildcard must occupy the entire level", filter)
+		}
+	}
+
+	return nil
+}
+
+// Filter allows topics matching any of the included filters and none of the excluded ones
+type Filter struct {
+	include []string
+	exclude []string
+}
+
+// NewFilter creates a new Filter, empty include list allows all topics
+func NewFilter(include, exclude []string) (*Filter, error) {
+	for _, f := range append(slices.Clone(include), exclude...) {
+		if err := Validate(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Filter{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+// Allow reports whether the topic passes the filter
+func (f *Filter) Allow(topic string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) != 0 && !MatchAny(f.include, topic) {
+		return false
+	}
+	return !MatchAny(f.exclude, topic)
+}
@@ -0,0 +1,91 @@
+package topic
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "zigbee2mqtt/lamp", topic: "zigbee2mqtt/lamp", want: true},
+		{filter: "zigbee2mqtt/lamp", topic: "zigbee2mqtt/lamp/set", want: false},
+		{filter: "zigbee2mqtt/+", topic: "zigbee2mqtt/lamp", want: true},
+		{filter: "zigbee2mqtt/+", topic: "zigbee2mqtt/lamp/set", want: false},
+		{filter: "zigbee2mqtt/+/set", topic: "zigbee2mqtt/lamp/set", want: true},
+		{filter: "zigbee2mqtt/+/set", topic: "zigbee2mqtt/lamp/get", want: false},
+		{filter: "zigbee2mqtt/+", topic: "zigbee2mqtt/", want: true},
+		{filter: "zigbee2mqtt/#", topic: "zigbee2mqtt", want: true},
+		{filter: "zigbee2mqtt/#", topic: "zigbee2mqtt/bridge/logging", want: true},
+		{filter: "zigbee2mqtt/#", topic: "home/zigbee2mqtt", want: false},
+		{filter: "+/+", topic: "/lamp", want: true},
+		{filter: "#", topic: "zigbee2mqtt/lamp", want: true},
+		{filter: "#", topic: "$SYS/broker/uptime", want: false},
+		{filter: "+/broker/uptime", topic: "$SYS/broker/uptime", want: false},
+		{filter: "$SYS/#", topic: "$SYS/broker/uptime", want: true},
+		{filter: "Zigbee2mqtt/lamp", topic: "zigbee2mqtt/lamp", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{filter: "zigbee2mqtt/#", valid: true},
+		{filter: "+/lamp/+", valid: true},
+		{filter: "#", valid: true},
+		{filter: "", valid: false},
+		{filter: "zigbee2mqtt/#/set", valid: false},
+		{filter: "zigbee2mqtt/lamp#", valid: false},
+		{filter: "zigbee2mqtt/+lamp", valid: false},
+	}
+
+	for _, tt := range tests {
+		if err := Validate(tt.filter); (err == nil) != tt.valid {
+			t.Errorf("Validate(%q) = %v, want valid %v", tt.filter, err, tt.valid)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter([]string{"zigbee2mqtt/#"}, []string{"zigbee2mqtt/bridge/logging", "zigbee2mqtt/+/set"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{topic: "zigbee2mqtt/lamp", want: true},
+		{topic: "zigbee2mqtt/bridge/state", want: true},
+		{topic: "zigbee2mqtt/bridge/logging", want: false},
+		{topic: "zigbee2mqtt/lamp/set", want: false},
+		{topic: "home/lamp", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := f.Allow(tt.topic); got != tt.want {
+			t.Errorf("Allow(%q) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+
+	all, err := NewFilter(nil, []string{"zigbee2mqtt/bridge/logging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all.Allow("home/lamp") || all.Allow("zigbee2mqtt/bridge/logging") {
+		t.Fatal("empty include list must allow all topics except excluded")
+	}
+
+	if _, err := NewFilter([]string{"zigbee2mqtt/#/set"}, nil); err == nil {
+		t.Fatal("expected error for invalid filter")
+	}
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestPropagation(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "send")
+	carrier := Inject(ctx)
+	span.End()
+
+	if len(carrier["traceparent"]) == 0 {
+		t.Fatalf("trace context is not injected %v", carrier)
+	}
+
+	_, child := tp.Tracer("test").Start(Extract(context.Background(), carrier), "receive")
+	child.End()
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[1].SpanContext.TraceID() != spans[0].SpanContext.TraceID() {
+		t.Fatal("trace is not continued")
+	}
+	if spans[1].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Fatal("unexpected parent span")
+	}
+}
+
+func TestInjectWithoutTrace(t *testing.T) {
+	if carrier := Inject(context.Background()); carrier != nil {
+		t.Fatalf("unexpected trace context %v", carrier)
+	}
+
+	ctx := Extract(context.Background(), nil)
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("unexpected span context")
+	}
+}
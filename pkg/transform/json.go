@@ -0,0 +1,76 @@
+package transform
+
+import (
+	"fmt"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+)
+
+// JSONOptions operations on top level fields of a JSON object, applied in the order:
+// include, exclude, rename, set. Empty Include keeps all fields. Renames are applied in no particular order,
+// so a field can not be renamed to a field which is renamed itself and two fields can not be renamed to the same one.
+type JSONOptions struct {
+	Include []string
+	Exclude []string
+	Rename  map[string]string
+	Set     map[string]interface{}
+}
+
+// JSON transforms JSON object payloads, other payloads are not changed
+type JSON struct {
+	codec codec.Codec
+	opts  JSONOptions
+}
+
+// NewJSON creates a new JSON transformer
+func NewJSON(c codec.Codec, opts JSONOptions) (*JSON, error) {
+	targets := make(map[string]string, len(opts.Rename))
+	for from, to := range opts.Rename {
+		if _, ok := opts.Rename[to]; ok && from != to {
+			return nil, fmt.Errorf("field %s is renamed to %s which is renamed itself", from, to)
+		}
+		if other, ok := targets[to]; ok {
+			return nil, fmt.Errorf("fields %s and %s are renamed to the same field %s", other, from, to)
+		}
+		targets[to] = from
+	}
+
+	return &JSON{
+		codec: c,
+		opts:  opts,
+	}, nil
+}
+
+func (j *JSON) Transform(_ string, payload []byte) ([]byte, error) {
+	var obj map[string]interface{}
+	if err := j.codec.Unmarshal(payload, &obj); err != nil || obj == nil {
+		return payload, nil
+	}
+
+	if len(j.opts.Include) != 0 {
+		included := make(map[string]interface{}, len(j.opts.Include))
+		for _, k := range j.opts.Include {
+			if v, ok := obj[k]; ok {
+				included[k] = v
+			}
+		}
+		obj = included
+	}
+
+	for _, k := range j.opts.Exclude {
+		delete(obj, k)
+	}
+
+	for from, to := range j.opts.Rename {
+		if v, ok := obj[from]; ok {
+			delete(obj, from)
+			obj[to] = v
+		}
+	}
+
+	for k, v := range j.opts.Set {
+		obj[k] = v
+	}
+
+	return j.codec.Marshal(obj)
+}
@@ -0,0 +1,49 @@
+// Package transform provides message payload transformations
+package transform
+
+import (
+	"github.com/forest33/mqtt-sync/pkg/topic"
+)
+
+// Transformer transforms the message payload
+type Transformer interface {
+	Transform(topic string, payload []byte) ([]byte, error)
+}
+
+type stage struct {
+	filter string
+	t      Transformer
+}
+
+// Pipeline applies transformers of all stages matching the topic in order
+type Pipeline struct {
+	stages []stage
+}
+
+// NewPipeline creates a new empty Pipeline
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Add adds the transformer applied to topics matching the filter
+func (p *Pipeline) Add(filter string, t Transformer) error {
+	if err := topic.Validate(filter); err != nil {
+		return err
+	}
+	p.stages = append(p.stages, stage{filter: filter, t: t})
+	return nil
+}
+
+// Transform transforms the payload, the payload is returned as is when no stage matches the topic
+func (p *Pipeline) Transform(t string, payload []byte) ([]byte, error) {
+	var err error
+	for _, s := range p.stages {
+		if !topic.Match(s.filter, t) {
+			continue
+		}
+		if payload, err = s.t.Transform(t, payload); err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
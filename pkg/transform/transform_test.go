@@ -0,0 +1,142 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/forest33/mqtt-sync/pkg/codec"
+)
+
+func TestJSON(t *testing.T) {
+	c := codec.NewFastJsonCodec()
+
+	tests := []struct {
+		name    string
+		opts    JSONOptions
+		payload string
+		want    string
+	}{
+		{
+			name:    "exclude",
+			opts:    JSONOptions{Exclude: []string{"linkquality", "last_seen"}},
+			payload: `{"state":"ON","linkquality":120,"last_seen":"2024-01-01T00:00:00Z"}`,
+			want:    `{"state":"ON"}`,
+		},
+		{
+			name:    "include",
+			opts:    JSONOptions{Include: []string{"state", "brightness"}},
+			payload: `{"state":"ON","brightness":254,"color_temp":370}`,
+			want:    `{"brightness":254,"state":"ON"}`,
+		},
+		{
+			name:    "rename and set",
+			opts:    JSONOptions{Rename: map[string]string{"temperature": "temp_c"}, Set: map[string]interface{}{"source": "home"}},
+			payload: `{"temperature":21.5}`,
+			want:    `{"source":"home","temp_c":21.5}`,
+		},
+		{
+			name:    "large numbers are kept",
+			opts:    JSONOptions{Exclude: []string{"linkquality"}},
+			payload: `{"energy":12345678901234567890,"linkquality":1}`,
+			want:    `{"energy":12345678901234567890}`,
+		},
+		{
+			name:    "not an object",
+			opts:    JSONOptions{Exclude: []string{"linkquality"}},
+			payload: `ON`,
+			want:    `ON`,
+		},
+		{
+			name:    "array",
+			opts:    JSONOptions{Exclude: []string{"linkquality"}},
+			payload: `[1,2]`,
+			want:    `[1,2]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, err := NewJSON(c, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := j.Transform("zigbee2mqtt/lamp", []byte(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	p := NewPipeline()
+
+	if err := p.Add("zigbee2mqtt/#", newTestJSON(t, JSONOptions{Exclude: []string{"linkquality"}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("zigbee2mqtt/+/state", newTestJSON(t, JSONOptions{Set: map[string]interface{}{"source": "home"}})); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Add("zigbee2mqtt/#/set", newTestJSON(t, JSONOptions{})); err == nil {
+		t.Fatal("expected error for invalid filter")
+	}
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{topic: "zigbee2mqtt/lamp/state", want: `{"source":"home","state":"ON"}`},
+		{topic: "zigbee2mqtt/lamp", want: `{"state":"ON"}`},
+		{topic: "home/lamp", want: `{"state":"ON","linkquality":1}`},
+	}
+
+	for _, tt := range tests {
+		got, err := p.Transform(tt.topic, []byte(`{"state":"ON","linkquality":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Transform(%q) = %s, want %s", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestJSONRenameChain(t *testing.T) {
+	c := codec.NewFastJsonCodec()
+
+	invalid := map[string]map[string]string{
+		"chain":       {"a": "b", "b": "c"},
+		"swap":        {"a": "b", "b": "a"},
+		"same target": {"a": "c", "b": "c"},
+	}
+	for name, rename := range invalid {
+		if _, err := NewJSON(c, JSONOptions{Rename: rename}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// the result does not depend on the order of renames
+	j := newTestJSON(t, JSONOptions{Rename: map[string]string{"a": "x", "b": "y", "c": "c"}})
+	for i := 0; i < 20; i++ {
+		got, err := j.Transform("zigbee2mqtt/lamp", []byte(`{"a":1,"b":2,"c":3}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != `{"c":3,"x":1,"y":2}` {
+			t.Fatalf("unexpected result %s", got)
+		}
+	}
+}
+
+func newTestJSON(t *testing.T, opts JSONOptions) *JSON {
+	t.Helper()
+
+	j, err := NewJSON(codec.NewFastJsonCodec(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j
+}